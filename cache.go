@@ -1,25 +1,53 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
 
+var (
+	cacheBucket = []byte("cache")
+	metaBucket  = []byte("meta")
+)
+
+// Cache stores downloaded pages in a bolt database, it is safe for concurrent use.
+// The page body is stored in the cache bucket and the headers used for
+// revalidation in the meta bucket under the same key.
 type Cache struct {
 	db *bolt.DB
 }
 
-func newCache() *Cache {
-	db, err := bolt.Open("cache.db", 0600, nil)
+// cacheEntry is a cached response
+type cacheEntry struct {
+	Body         []byte    `json:"-"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Location     string    `json:"location,omitempty"` // URL after redirects
+	Fetched      time.Time `json:"fetched"`
+}
+
+// fresh returns true if the entry is younger than the ttl. Entries cached
+// before the fetch time was stored are stale, they are revalidated once and
+// stamped with the time of the revalidation.
+func (e *cacheEntry) fresh(ttl time.Duration) bool {
+	return !e.Fetched.IsZero() && time.Since(e.Fetched) < ttl
+}
+
+func newCache(file string) *Cache {
+	db, err := bolt.Open(file, 0600, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
 	db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("cache"))
-		if err != nil {
-			return fmt.Errorf("create bucket (cache): %v", err)
+		for _, name := range [][]byte{cacheBucket, metaBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return fmt.Errorf("create bucket (%s): %v", name, err)
+			}
 		}
 		return nil
 	})
@@ -28,25 +56,112 @@ func newCache() *Cache {
 	}
 }
 
-func (c *Cache) set(k string, v []byte) {
+func (c *Cache) set(k string, e *cacheEntry) {
 	err := c.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("cache"))
-		err := b.Put([]byte(k), v)
+		return put(tx, k, e)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// put stores an entry in the transaction
+func put(tx *bolt.Tx, k string, e *cacheEntry) error {
+	meta, err := json.Marshal(e)
+	if err != nil {
 		return err
+	}
+	if err := tx.Bucket(cacheBucket).Put([]byte(k), e.Body); err != nil {
+		return err
+	}
+	return tx.Bucket(metaBucket).Put([]byte(k), meta)
+}
+
+// setNewer stores the entries in a single transaction, an existing entry is
+// only replaced by a newer one. It returns the number of entries stored.
+func (c *Cache) setNewer(keys []string, entries []*cacheEntry) int {
+	stored := 0
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		for i, k := range keys {
+			if tx.Bucket(cacheBucket).Get([]byte(k)) != nil {
+				var old cacheEntry
+				if meta := tx.Bucket(metaBucket).Get([]byte(k)); meta != nil {
+					if err := json.Unmarshal(meta, &old); err != nil {
+						log.Printf("invalid cache metadata for %s: %v", k, err)
+					}
+				}
+				if !old.Fetched.Before(entries[i].Fetched) {
+					continue
+				}
+			}
+			if err := put(tx, k, entries[i]); err != nil {
+				return err
+			}
+			stored++
+		}
+		return nil
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
+	return stored
 }
 
-func (c *Cache) get(k string) []byte {
-	var val []byte
+// get returns the cached entry or nil, entries created before the meta bucket
+// existed have a zero fetched time
+func (c *Cache) get(k string) *cacheEntry {
+	var e *cacheEntry
 	c.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("cache"))
-		val = b.Get([]byte(k))
+		// the value is only valid during the transaction
+		v := tx.Bucket(cacheBucket).Get([]byte(k))
+		if v == nil {
+			return nil
+		}
+		e = &cacheEntry{}
+		if meta := tx.Bucket(metaBucket).Get([]byte(k)); meta != nil {
+			if err := json.Unmarshal(meta, e); err != nil {
+				log.Printf("invalid cache metadata for %s: %v", k, err)
+			}
+		}
+		e.Body = append([]byte(nil), v...)
 		return nil
 	})
-	return val
+	return e
+}
+
+// each calls fn for every entry in key order, stopping on the first error. The
+// entry body is only valid inside fn.
+func (c *Cache) each(fn func(k string, e *cacheEntry) error) error {
+	return c.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		return tx.Bucket(cacheBucket).ForEach(func(k, v []byte) error {
+			e := &cacheEntry{Body: v}
+			if m := meta.Get(k); m != nil {
+				if err := json.Unmarshal(m, e); err != nil {
+					return fmt.Errorf("invalid cache metadata for %s: %v", k, err)
+				}
+			}
+			return fn(string(k), e)
+		})
+	})
+}
+
+// delete removes the entries
+func (c *Cache) delete(keys []string) {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		for _, k := range keys {
+			if err := tx.Bucket(cacheBucket).Delete([]byte(k)); err != nil {
+				return err
+			}
+			if err := tx.Bucket(metaBucket).Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 func (c *Cache) close() error {
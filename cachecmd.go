@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const cacheUsage = `Usage: %s cache [-db file] command [flags]
+Commands:
+  list [-prefix url]                            list entries with their size and time
+  purge [-prefix url] [-older-than age] [-all]  remove matching entries
+  stats                                         show the number and size of entries
+  export file                                   write all entries to a gzipped archive
+  import file                                   read entries from an archive
+Flags:
+`
+
+// number of archive entries imported in a single transaction
+const importBatch = 1000
+
+// archiveEntry is a cache entry in an exported archive, one JSON object per line
+type archiveEntry struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Location     string    `json:"location,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+	Body         []byte    `json:"body"`
+}
+
+// cacheCommand runs the cache subcommand
+func cacheCommand(args []string) {
+	fs := flag.NewFlagSet("cache", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, cacheUsage, os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	var dbFile string
+	fs.StringVar(&dbFile, "db", "cache.db", "Path of the cache database")
+
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+	// only import creates the database
+	if _, err := os.Stat(dbFile); err != nil && cmd != "import" {
+		log.Fatal(err)
+	}
+	c := newCache(dbFile)
+	defer c.close()
+
+	switch cmd {
+	case "list":
+		cacheList(c, args)
+	case "purge":
+		cachePurge(c, args)
+	case "stats":
+		cacheStats(c)
+	case "export":
+		if len(args) != 1 {
+			fs.Usage()
+			os.Exit(1)
+		}
+		cacheExport(c, args[0])
+	case "import":
+		if len(args) != 1 {
+			fs.Usage()
+			os.Exit(1)
+		}
+		cacheImport(c, args[0])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown cache command: %s\n", cmd)
+		fs.Usage()
+		os.Exit(1)
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+func cacheList(c *Cache, args []string) {
+	fs := flag.NewFlagSet("cache list", flag.ExitOnError)
+	var prefix string
+	fs.StringVar(&prefix, "prefix", "", "Only list URLs starting with the prefix")
+	fs.Parse(args)
+
+	err := c.each(func(k string, e *cacheEntry) error {
+		if strings.HasPrefix(k, prefix) {
+			fmt.Printf("%10d  %s  %s\n", len(e.Body), formatTime(e.Fetched), k)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func cachePurge(c *Cache, args []string) {
+	fs := flag.NewFlagSet("cache purge", flag.ExitOnError)
+	var prefix string
+	fs.StringVar(&prefix, "prefix", "", "Only remove URLs starting with the prefix")
+	var olderThan time.Duration
+	fs.DurationVar(&olderThan, "older-than", 0, "Only remove entries older than the age")
+	var all bool
+	fs.BoolVar(&all, "all", false, "Remove all entries")
+	fs.Parse(args)
+
+	if prefix == "" && olderThan == 0 && !all {
+		log.Fatal("purge needs -prefix, -older-than or -all")
+	}
+
+	keys := make([]string, 0)
+	err := c.each(func(k string, e *cacheEntry) error {
+		if !strings.HasPrefix(k, prefix) {
+			return nil
+		}
+		// entries without a fetched time are stale like in fresh and always older
+		if olderThan > 0 && !e.Fetched.IsZero() && time.Since(e.Fetched) < olderThan {
+			return nil
+		}
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.delete(keys)
+	fmt.Printf("Removed %d entries\n", len(keys))
+}
+
+func cacheStats(c *Cache) {
+	var (
+		count, size, validated int
+		oldest, newest         time.Time
+	)
+	err := c.each(func(k string, e *cacheEntry) error {
+		count++
+		size += len(e.Body)
+		if e.ETag != "" || e.LastModified != "" {
+			validated++
+		}
+		if !e.Fetched.IsZero() {
+			if oldest.IsZero() || e.Fetched.Before(oldest) {
+				oldest = e.Fetched
+			}
+			if e.Fetched.After(newest) {
+				newest = e.Fetched
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Entries:         %d\n", count)
+	fmt.Printf("Total size:      %d\n", size)
+	fmt.Printf("With validators: %d\n", validated)
+	fmt.Printf("Oldest:          %s\n", formatTime(oldest))
+	fmt.Printf("Newest:          %s\n", formatTime(newest))
+	if fi, err := os.Stat(c.db.Path()); err == nil {
+		fmt.Printf("Database size:   %d\n", fi.Size())
+	}
+}
+
+func cacheExport(c *Cache, file string) {
+	f, err := os.Create(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	enc := json.NewEncoder(zw)
+
+	count := 0
+	err = c.each(func(k string, e *cacheEntry) error {
+		count++
+		return enc.Encode(&archiveEntry{
+			URL:          k,
+			ETag:         e.ETag,
+			LastModified: e.LastModified,
+			Location:     e.Location,
+			Fetched:      e.Fetched,
+			Body:         e.Body,
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Exported %d entries to %s\n", count, file)
+}
+
+// cacheImport adds the archive entries to the cache in batches, existing
+// entries are only replaced by newer ones
+func cacheImport(c *Cache, file string) {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		log.Fatal(err)
+	}
+	dec := json.NewDecoder(zr)
+
+	var (
+		imported, skipped int
+		keys              = make([]string, 0, importBatch)
+		entries           = make([]*cacheEntry, 0, importBatch)
+	)
+	flush := func() {
+		n := c.setNewer(keys, entries)
+		imported += n
+		skipped += len(keys) - n
+		keys, entries = keys[:0], entries[:0]
+	}
+	for {
+		var a archiveEntry
+		if err := dec.Decode(&a); err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatal(err)
+		}
+		keys = append(keys, a.URL)
+		entries = append(entries, &cacheEntry{
+			Body:         a.Body,
+			ETag:         a.ETag,
+			LastModified: a.LastModified,
+			Location:     a.Location,
+			Fetched:      a.Fetched,
+		})
+		if len(keys) == importBatch {
+			flush()
+		}
+	}
+	flush()
+	fmt.Printf("Imported %d entries, skipped %d older entries\n", imported, skipped)
+}
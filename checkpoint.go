@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/char101/godoc-chm/chm"
+)
+
+const checkpointFile = "checkpoint.json"
+
+// checkpointEntry is a line of the checkpoint file. The first line only
+// contains the root URL, the following lines contain a finished package.
+type checkpointEntry struct {
+	Root      string       `json:"root,omitempty"`
+	URL       string       `json:"url,omitempty"`
+	Directory bool         `json:"directory,omitempty"`
+	Title     string       `json:"title,omitempty"`
+	Hash      string       `json:"hash,omitempty"`
+	Fragment  *chm.Project `json:"fragment,omitempty"`
+	Pages     []*page      `json:"pages,omitempty"`
+}
+
+// Checkpoint records the packages that have been downloaded together with
+// their toc and index so that an interrupted crawl can be resumed. It is safe
+// for concurrent use.
+type Checkpoint struct {
+	mu   sync.Mutex
+	f    *os.File
+	done map[string]*pkgResult
+}
+
+// checkpoint of the current crawl, nil when not crawling packages
+var checkpoint *Checkpoint
+
+// openCheckpoint creates a new checkpoint file, or when resuming loads the
+// packages finished by the previous run for the same root URL
+func openCheckpoint(root string, resume bool) *Checkpoint {
+	c := &Checkpoint{done: make(map[string]*pkgResult)}
+	var valid int64
+	if resume {
+		valid = c.load(root)
+	}
+
+	f, err := os.OpenFile(checkpointFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// drop the incomplete line of an interrupted write so that the next entries
+	// start on a new line
+	if len(c.done) == 0 {
+		valid = 0
+	}
+	if err := f.Truncate(valid); err != nil {
+		log.Fatal(err)
+	}
+	c.f = f
+	if len(c.done) == 0 {
+		c.write(&checkpointEntry{Root: root})
+	}
+	return c
+}
+
+// load reads the packages of the checkpoint and returns the size of its valid
+// lines
+func (c *Checkpoint) load(root string) int64 {
+	f, err := os.Open(checkpointFile)
+	if os.IsNotExist(err) {
+		log.Println("no checkpoint found, starting from the beginning")
+		return 0
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var valid int64
+	for line := 0; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// the last line is incomplete if the previous run was killed while writing
+			if len(data) > 0 {
+				log.Printf("ignoring incomplete checkpoint line %d", line+1)
+			}
+			break
+		} else if err != nil {
+			log.Fatal(err)
+		}
+		var e checkpointEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			log.Printf("ignoring invalid checkpoint line %d: %v", line+1, err)
+			break
+		}
+		valid += int64(len(data))
+		if line == 0 {
+			if e.Root != root {
+				log.Fatalf("checkpoint is for %s, not %s", e.Root, root)
+			}
+			continue
+		}
+		c.done[e.URL] = &pkgResult{fragment: e.Fragment, directory: e.Directory, title: e.Title, hash: e.Hash, pages: e.Pages}
+	}
+	log.Printf("resuming with %d packages from the checkpoint", len(c.done))
+	return valid
+}
+
+func (c *Checkpoint) write(e *checkpointEntry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.f.Write(append(data, '\n')); err != nil {
+		log.Fatal(err)
+	}
+	if err := c.f.Sync(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// get returns the result of a package finished by the previous run
+func (c *Checkpoint) get(url string) *pkgResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done[url]
+}
+
+// add records a finished package
+func (c *Checkpoint) add(url string, res *pkgResult) {
+	c.write(&checkpointEntry{URL: url, Directory: res.directory, Title: res.title, Hash: res.hash, Fragment: res.fragment, Pages: res.pages})
+}
+
+// remove deletes the checkpoint after a complete build
+func (c *Checkpoint) remove() {
+	c.f.Close()
+	if err := os.Remove(checkpointFile); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/char101/godoc-chm/chm"
+)
+
+// interrupt appends the beginning of an entry like a run killed while writing
+func interrupt(t *testing.T) {
+	f, err := os.OpenFile(checkpointFile, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"url":"http://localhost/pkg/partial/","title":"par`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func TestCheckpointResume(t *testing.T) {
+	t.Chdir(t.TempDir())
+	const root = "http://localhost/pkg/"
+	done := func(c *Checkpoint) []string {
+		var urls []string
+		for url := range c.done {
+			urls = append(urls, url)
+		}
+		sort.Strings(urls)
+		return urls
+	}
+	add := func(c *Checkpoint, pkg string) {
+		c.add(root+pkg+"/", &pkgResult{fragment: chm.NewProject(pkg), title: pkg})
+	}
+
+	c := openCheckpoint(root, false)
+	add(c, "a")
+	c.f.Close()
+	interrupt(t)
+
+	c = openCheckpoint(root, true)
+	if got := done(c); len(got) != 1 || got[0] != root+"a/" {
+		t.Fatalf("first resume has %v", got)
+	}
+	add(c, "b")
+	c.f.Close()
+	interrupt(t)
+
+	c = openCheckpoint(root, true)
+	got := done(c)
+	if len(got) != 2 || got[0] != root+"a/" || got[1] != root+"b/" {
+		t.Fatalf("second resume has %v", got)
+	}
+	if res := c.get(root + "b/"); res.title != "b" || res.fragment == nil {
+		t.Errorf("package b = %+v", res)
+	}
+	add(c, "c")
+	c.f.Close()
+
+	c = openCheckpoint(root, true)
+	if got := done(c); len(got) != 3 {
+		t.Errorf("third resume has %v", got)
+	}
+	c.f.Close()
+
+	// a new crawl starts with an empty checkpoint
+	c = openCheckpoint(root, false)
+	if got := done(c); len(got) != 0 {
+		t.Errorf("new crawl has %v", got)
+	}
+	c.remove()
+}
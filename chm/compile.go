@@ -0,0 +1,369 @@
+package chm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	// #STRINGS, #URLTBL and #URLSTR are read in blocks, an entry never
+	// crosses a block
+	systemBlockSize = 0x1000
+	urltblEntrySize = 12
+	// the last 4 bytes of a #URLTBL block are unused
+	urltblBlockEntries = (systemBlockSize - 4) / urltblEntrySize
+
+	// #TOPICS flags
+	topicInContents = 6
+	topicNotInToc   = 2
+
+	lzxTransformGUID = "{7FC28940-9D31-11D0-9B27-00A0C91E9C7C}"
+	lzxStorage       = "::DataSpace/Storage/MSCompressed/"
+)
+
+// HH_WINTYPE fsValidMembers flags
+const (
+	winParamProperties = 1 << 1
+	winParamStyles     = 1 << 2
+	winParamExStyles   = 1 << 3
+	winParamRect       = 1 << 4
+	winParamNavWidth   = 1 << 5
+	winParamShowState  = 1 << 6
+	winParamTbFlags    = 1 << 8
+	winParamExpansion  = 1 << 9
+	winParamTabPos     = 1 << 10
+	winParamCurTab     = 1 << 13
+)
+
+var titleRe = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// CompileNative writes the compiled file of the project without HTML Help
+// Workshop, the files of the project are read from the current directory
+func (p *Project) CompileNative() error {
+	fmt.Println("Compiling", p.GetCompiledFile())
+	f, err := os.Create(p.GetCompiledFile())
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := p.WriteCHM(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// WriteCHM writes the project as a compiled CHM file. The content is
+// compressed in LZX verbatim blocks while the files are read, only the
+// compressed stream is kept in memory. The table of contents and the index
+// are stored as sitemaps like a project compiled without binary index.
+func (p *Project) WriteCHM(w io.Writer) error {
+	var (
+		contents = p.options["Contents File"]
+		index    = p.options["Index File"]
+		// section 1 is the concatenation of the files in the order they are
+		// added
+		enc     = newLZXEncoder()
+		entries = make([]*itsfEntry, 0, len(p.files)+32)
+		added   = make(map[string]bool)
+		dirs    = map[string]bool{"/": true}
+	)
+	add := func(name string, data []byte) {
+		name = "/" + strings.TrimPrefix(strings.Replace(name, `\`, "/", -1), "/")
+		if added[name] {
+			return
+		}
+		added[name] = true
+		entries = append(entries, &itsfEntry{name: name, section: 1, offset: uint64(enc.Len()), length: uint64(len(data))})
+		enc.Write(data)
+		for d := name[:strings.LastIndex(name, "/")+1]; d != "" && !dirs[d]; d = d[:strings.LastIndex(d[:len(d)-1], "/")+1] {
+			dirs[d] = true
+		}
+	}
+
+	topics := make([]string, 0)
+	titles := make(map[string]string)
+	for _, f := range p.GetFiles() {
+		data, err := os.ReadFile(filepath.FromSlash(strings.Replace(f, `\`, "/", -1)))
+		if err != nil {
+			return err
+		}
+		add(f, data)
+		if ext := strings.ToLower(filepath.Ext(f)); ext == ".html" || ext == ".htm" {
+			t := strings.Replace(f, `\`, "/", -1)
+			topics = append(topics, t)
+			if m := titleRe.FindSubmatch(data); m != nil {
+				titles[t] = CleanTitle(html.UnescapeString(string(m[1])))
+			}
+		}
+	}
+
+	var b Buffer
+	p.toc.Serialize(&b)
+	add(contents, b.Bytes())
+	b = Buffer{}
+	p.index.Serialize(&b)
+	add(index, b.Bytes())
+
+	lang := uint32(0x409)
+	if fields := strings.Fields(p.options["Language"]); len(fields) > 0 {
+		if v, err := strconv.ParseUint(fields[0], 0, 32); err == nil {
+			lang = uint32(v)
+		}
+	}
+
+	strs := newStringTable()
+	topicsFile, urltbl, urlstr := p.topicFiles(topics, titles, strs)
+	windows := p.windowsFile(strs)
+	add("#TOPICS", topicsFile)
+	add("#URLTBL", urltbl)
+	add("#URLSTR", urlstr)
+	add("#WINDOWS", windows)
+	add("#STRINGS", strs.bytes())
+	for d := range dirs {
+		entries = append(entries, &itsfEntry{name: d})
+	}
+
+	length := enc.Len()
+	compressed, offsets := enc.Close()
+	var (
+		section0 [][]byte
+		size0    uint64
+		add0     = func(name string, data []byte) {
+			entries = append(entries, &itsfEntry{name: name, offset: size0, length: uint64(len(data))})
+			section0 = append(section0, data)
+			size0 += uint64(len(data))
+		}
+		spanInfo = make([]byte, 8)
+	)
+	binary.LittleEndian.PutUint64(spanInfo, uint64(length))
+	add0("::DataSpace/NameList", nameList("Uncompressed", "MSCompressed"))
+	add0(lzxStorage+"Content", compressed)
+	add0(lzxStorage+"ControlData", lzxControlData())
+	add0(lzxStorage+"SpanInfo", spanInfo)
+	add0(lzxStorage+"Transform/List", utf16le(lzxTransformGUID))
+	add0(lzxStorage+"Transform/"+lzxTransformGUID+"/InstanceData/ResetTable", lzxResetTable(length, len(compressed), offsets))
+	add0("/#SYSTEM", p.systemFile(lang))
+	add0("/#ITBITS", nil)
+
+	return writeITSF(w, entries, section0, lang)
+}
+
+// stringTable builds the #STRINGS file, the strings are referenced by offset
+type stringTable struct {
+	buf     bytes.Buffer
+	offsets map[string]uint32
+}
+
+func newStringTable() *stringTable {
+	t := &stringTable{offsets: make(map[string]uint32)}
+	t.buf.WriteByte(0)
+	return t
+}
+
+// add returns the offset of a string, 0 is the empty string
+func (t *stringTable) add(s string) uint32 {
+	if s == "" {
+		return 0
+	}
+	if o, ok := t.offsets[s]; ok {
+		return o
+	}
+	padBlock(&t.buf, len(s)+1)
+	o := uint32(t.buf.Len())
+	t.buf.WriteString(s)
+	t.buf.WriteByte(0)
+	t.offsets[s] = o
+	return o
+}
+
+func (t *stringTable) bytes() []byte {
+	return t.buf.Bytes()
+}
+
+// padBlock pads a file to the next block when n bytes do not fit in the
+// current one
+func padBlock(b *bytes.Buffer, n int) {
+	if used := b.Len() % systemBlockSize; used+n > systemBlockSize && n <= systemBlockSize {
+		b.Write(make([]byte, systemBlockSize-used))
+	}
+}
+
+// tocFiles returns the lowercased files linked from the table of contents
+func (p *Project) tocFiles() map[string]bool {
+	files := make(map[string]bool)
+	var walk func(t *TocItem)
+	walk = func(t *TocItem) {
+		if t.href != "" {
+			f, _, _ := strings.Cut(t.href, "#")
+			files[strings.ToLower(strings.Replace(f, `\`, "/", -1))] = true
+		}
+		for _, c := range t.children {
+			walk(c)
+		}
+	}
+	walk(p.toc.root)
+	return files
+}
+
+// topicFiles returns the #TOPICS, #URLTBL and #URLSTR files of the topics, the
+// titles of the topics are added to the string table
+func (p *Project) topicFiles(topics []string, titles map[string]string, strs *stringTable) (topicsFile, urltbl, urlstr []byte) {
+	var (
+		tb, ub, sb bytes.Buffer
+		inToc      = p.tocFiles()
+		le         = func(b *bytes.Buffer, v interface{}) { binary.Write(b, binary.LittleEndian, v) }
+	)
+	sb.WriteByte(0)
+	for i, t := range topics {
+		title := uint32(0xffffffff)
+		if s := titles[t]; s != "" {
+			title = strs.add(s)
+		}
+
+		padBlock(&sb, 8+len(t)+1)
+		str := uint32(sb.Len())
+		le(&sb, uint32(0))
+		le(&sb, uint32(0))
+		sb.WriteString(t)
+		sb.WriteByte(0)
+
+		if i > 0 && i%urltblBlockEntries == 0 {
+			ub.Write(make([]byte, systemBlockSize-ub.Len()%systemBlockSize))
+		}
+		url := uint32(ub.Len())
+		le(&ub, uint32(i))
+		le(&ub, uint32(i))
+		le(&ub, str)
+
+		flags := uint16(topicNotInToc)
+		if inToc[strings.ToLower(t)] {
+			flags = topicInContents
+		}
+		le(&tb, uint32(0))
+		le(&tb, title)
+		le(&tb, url)
+		le(&tb, flags)
+		le(&tb, uint16(0))
+	}
+	return tb.Bytes(), ub.Bytes(), sb.Bytes()
+}
+
+// windowsFile returns the #WINDOWS file with the main window, the strings of
+// the window are added to the string table
+func (p *Project) windowsFile(strs *stringTable) []byte {
+	const entrySize = 0xc4
+	var (
+		e     = make([]byte, entrySize)
+		valid = uint32(0)
+		opt   = func(k string) string { return strings.Replace(p.windowOptions[k], `\`, "/", -1) }
+		put   = func(offset int, v uint32) { binary.LittleEndian.PutUint32(e[offset:], v) }
+		num   = func(offset int, k string, flag uint32) {
+			if v, err := strconv.ParseUint(p.windowOptions[k], 0, 32); err == nil {
+				put(offset, uint32(v))
+				valid |= flag
+			}
+		}
+	)
+	put(0x00, entrySize)
+	put(0x08, strs.add("main"))
+	num(0x10, "navigation_pane_styles", winParamProperties)
+	put(0x14, strs.add(opt("title")))
+	num(0x18, "style_flags", winParamStyles)
+	num(0x1c, "extended_style_flags", winParamExStyles)
+	if r := strings.Split(strings.Trim(p.windowOptions["initial_position"], "[]"), ","); len(r) == 4 {
+		for i, s := range r {
+			if v, err := strconv.ParseInt(strings.TrimSpace(s), 0, 32); err == nil {
+				put(0x20+4*i, uint32(v))
+				valid |= winParamRect
+			}
+		}
+	}
+	num(0x30, "window_show_state", winParamShowState)
+	num(0x44, "navigation_pane_width", winParamNavWidth)
+	put(0x60, strs.add(opt("contents_file")))
+	put(0x64, strs.add(opt("index_file")))
+	put(0x68, strs.add(opt("default_topic")))
+	put(0x6c, strs.add(opt("home")))
+	num(0x70, "buttons", winParamTbFlags)
+	num(0x74, "navigation_pane_closed", winParamExpansion)
+	num(0x78, "default_navigation_pane", winParamCurTab)
+	num(0x7c, "navigation_pane_position", winParamTabPos)
+	num(0x80, "id", 0)
+	put(0x0c, valid)
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, uint32(1))
+	binary.Write(&b, binary.LittleEndian, uint32(entrySize))
+	b.Write(e)
+	return b.Bytes()
+}
+
+// systemFile returns the #SYSTEM file, a version followed by records of a
+// code, a length and the data
+func (p *Project) systemFile(lang uint32) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, uint32(3))
+	record := func(code uint16, data []byte) {
+		binary.Write(&b, binary.LittleEndian, code)
+		binary.Write(&b, binary.LittleEndian, uint16(len(data)))
+		b.Write(data)
+	}
+	str := func(s string) []byte { return append([]byte(strings.Replace(s, `\`, "/", -1)), 0) }
+	dword := func(v uint32) []byte { return binary.LittleEndian.AppendUint32(nil, v) }
+
+	record(0, str(p.options["Contents File"]))
+	record(1, str(p.options["Index File"]))
+	record(2, str(p.windowOptions["default_topic"]))
+	record(3, str(p.windowOptions["title"]))
+	// language, DBCS, full text search, KLinks and ALinks, timestamp and two
+	// unknown values
+	info := make([]byte, 36)
+	binary.LittleEndian.PutUint32(info, lang)
+	record(4, info)
+	record(5, str(p.options["Default Window"]))
+	compiled := filepath.Base(p.GetCompiledFile())
+	record(6, str(strings.TrimSuffix(compiled, filepath.Ext(compiled))))
+	record(9, str("HHA Version 4.74.8702"))
+	record(12, dword(0))
+	return b.Bytes()
+}
+
+// nameList returns the ::DataSpace/NameList file listing the sections
+func nameList(sections ...string) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, uint16(0))
+	binary.Write(&b, binary.LittleEndian, uint16(len(sections)))
+	for _, s := range sections {
+		u := utf16.Encode([]rune(s))
+		binary.Write(&b, binary.LittleEndian, uint16(len(u)))
+		binary.Write(&b, binary.LittleEndian, u)
+		binary.Write(&b, binary.LittleEndian, uint16(0))
+	}
+	data := b.Bytes()
+	// the length of the file in words
+	binary.LittleEndian.PutUint16(data, uint16(len(data)/2))
+	return data
+}
+
+// utf16le returns a NUL terminated UTF-16 little endian string
+func utf16le(s string) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, utf16.Encode([]rune(s)))
+	binary.Write(&b, binary.LittleEndian, uint16(0))
+	return b.Bytes()
+}
@@ -0,0 +1,226 @@
+package chm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultHHWDir is the installation directory of HTML Help Workshop
+const DefaultHHWDir = `C:\Program Files (x86)\HTML Help Workshop`
+
+// Compilers are the names accepted by NewCompiler
+var Compilers = []string{"auto", "hhw", "chmcmd", "native", "stub"}
+
+// Compiler compiles a project saved in the current directory into its
+// compiled file
+type Compiler interface {
+	Name() string
+	Compile(p *Project) (*CompileResult, error)
+}
+
+// CompileResult is the outcome of a compilation
+type CompileResult struct {
+	Compiler    string        `json:"compiler"`
+	File        string        `json:"file"`
+	Size        int64         `json:"size"` // size of the compiled file, 0 if not written
+	Diagnostics []*Diagnostic `json:"diagnostics"`
+	Duration    time.Duration `json:"duration"`
+}
+
+// Count returns the number of diagnostics of a severity
+func (r *CompileResult) Count(s Severity) int {
+	n := 0
+	for _, d := range r.Diagnostics {
+		if d.Severity == s {
+			n++
+		}
+	}
+	return n
+}
+
+// Failed returns true if a diagnostic has at least the given severity
+func (r *CompileResult) Failed(threshold Severity) bool {
+	for _, d := range r.Diagnostics {
+		if d.Severity >= threshold {
+			return true
+		}
+	}
+	return false
+}
+
+// NewCompiler returns a compiler by name. The path is the installation
+// directory of HTML Help Workshop for hhw and the executable for chmcmd, the
+// default is used if empty. auto selects HTML Help Workshop if installed and
+// the native compiler otherwise.
+func NewCompiler(name, path string) (Compiler, error) {
+	switch name {
+	case "auto":
+		hhw := &HHW{Dir: path}
+		if hhw.Installed() {
+			return hhw, nil
+		}
+		return &NativeCompiler{}, nil
+	case "hhw":
+		return &HHW{Dir: path}, nil
+	case "chmcmd":
+		return &Chmcmd{Path: path}, nil
+	case "native":
+		return &NativeCompiler{}, nil
+	case "stub":
+		return &StubCompiler{}, nil
+	}
+	return nil, fmt.Errorf("unknown compiler %s, valid compilers are %s", name, strings.Join(Compilers, ", "))
+}
+
+// newResult returns the result of a compilation started at start
+func newResult(c Compiler, p *Project, start time.Time) *CompileResult {
+	r := &CompileResult{
+		Compiler:    c.Name(),
+		File:        p.GetCompiledFile(),
+		Diagnostics: make([]*Diagnostic, 0),
+		Duration:    time.Since(start),
+	}
+	if fi, err := os.Stat(r.File); err == nil && !fi.ModTime().Before(start.Truncate(time.Second)) {
+		r.Size = fi.Size()
+	}
+	return r
+}
+
+// HHW compiles with hhc.exe of HTML Help Workshop
+type HHW struct {
+	// Dir is the installation directory, DefaultHHWDir if empty
+	Dir string
+}
+
+func (c *HHW) dir() string {
+	if c.Dir == "" {
+		return DefaultHHWDir
+	}
+	return c.Dir
+}
+
+// Name returns hhw
+func (c *HHW) Name() string { return "hhw" }
+
+// Installed returns true if hhc.exe exists
+func (c *HHW) Installed() bool {
+	_, err := os.Stat(filepath.Join(c.dir(), "hhc.exe"))
+	return err == nil
+}
+
+// Compile runs hhc.exe on the project file. hhc.exe exits with 1 when the
+// compilation succeeds and with 0 when it fails.
+func (c *HHW) Compile(p *Project) (*CompileResult, error) {
+	start := time.Now()
+	log, code, err := runCompiler(filepath.Join(c.dir(), "hhc.exe"), p.name+".hhp")
+	r := newResult(c, p, start)
+	r.Diagnostics = ParseLog(log)
+	if err != nil {
+		return r, err
+	}
+	if code != 1 {
+		r.Diagnostics = append(r.Diagnostics, exitDiagnostic("hhc.exe", code))
+	}
+	return r, nil
+}
+
+// Open opens the project in hhw.exe
+func (c *HHW) Open(p *Project) error {
+	return exec.Command(filepath.Join(c.dir(), "hhw.exe"), p.name+".hhp").Run()
+}
+
+// Chmcmd compiles with chmcmd of Free Pascal or a tool taking the same
+// arguments
+type Chmcmd struct {
+	// Path is the executable, chmcmd in the PATH if empty
+	Path string
+}
+
+// Name returns chmcmd
+func (c *Chmcmd) Name() string { return "chmcmd" }
+
+// Compile runs chmcmd on the project file
+func (c *Chmcmd) Compile(p *Project) (*CompileResult, error) {
+	path := c.Path
+	if path == "" {
+		path = "chmcmd"
+	}
+	start := time.Now()
+	log, code, err := runCompiler(path, p.name+".hhp")
+	r := newResult(c, p, start)
+	r.Diagnostics = ParseLog(log)
+	if err != nil {
+		return r, err
+	}
+	if code != 0 {
+		r.Diagnostics = append(r.Diagnostics, exitDiagnostic(filepath.Base(path), code))
+	}
+	return r, nil
+}
+
+// NativeCompiler writes the compiled file with the chm package, see
+// Project.WriteCHM
+type NativeCompiler struct{}
+
+// Name returns native
+func (c *NativeCompiler) Name() string { return "native" }
+
+// Compile writes the compiled file of the project
+func (c *NativeCompiler) Compile(p *Project) (*CompileResult, error) {
+	start := time.Now()
+	err := p.CompileNative()
+	r := newResult(c, p, start)
+	if err != nil {
+		r.Diagnostics = append(r.Diagnostics, &Diagnostic{Severity: SeverityError, Message: err.Error()})
+	}
+	return r, err
+}
+
+// StubCompiler compiles nothing, it records the projects and returns the
+// configured result so that a build can be tested without a compiler
+type StubCompiler struct {
+	Result *CompileResult
+	Err    error
+	// Projects are the names of the projects compiled
+	Projects []string
+}
+
+// Name returns stub
+func (c *StubCompiler) Name() string { return "stub" }
+
+// Compile returns the configured result, or an empty result for the compiled
+// file of the project
+func (c *StubCompiler) Compile(p *Project) (*CompileResult, error) {
+	c.Projects = append(c.Projects, p.name)
+	if c.Result != nil {
+		return c.Result, c.Err
+	}
+	return &CompileResult{Compiler: c.Name(), File: p.GetCompiledFile(), Diagnostics: make([]*Diagnostic, 0)}, c.Err
+}
+
+// runCompiler runs an external compiler, its output is copied to the console
+// while it runs and returned with the exit code. The error is only set when
+// the compiler could not be run. It is replaced by the tests.
+var runCompiler = func(name string, args ...string) (string, int, error) {
+	var b strings.Builder
+	// the same writer for both streams is written by one goroutine at a time
+	w := io.MultiWriter(os.Stdout, &b)
+	c := exec.Command(name, args...)
+	c.Stdout = w
+	c.Stderr = w
+	err := c.Run()
+	if e, ok := err.(*exec.ExitError); ok {
+		return b.String(), e.ExitCode(), nil
+	}
+	return b.String(), 0, err
+}
+
+// exitDiagnostic returns the error of a compiler exiting with a failure code
+func exitDiagnostic(name string, code int) *Diagnostic {
+	return &Diagnostic{Severity: SeverityError, Message: fmt.Sprintf("%s failed with exit code %d", name, code)}
+}
@@ -0,0 +1,69 @@
+package chm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNewCompiler(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name, path, want string
+	}{
+		// hhc.exe is not installed in dir
+		{"auto", dir, "native"},
+		{"hhw", dir, "hhw"},
+		{"chmcmd", "", "chmcmd"},
+		{"native", "", "native"},
+		{"stub", "", "stub"},
+	}
+	for _, tt := range tests {
+		c, err := NewCompiler(tt.name, tt.path)
+		if err != nil {
+			t.Fatalf("NewCompiler(%s): %v", tt.name, err)
+		}
+		if c.Name() != tt.want {
+			t.Errorf("NewCompiler(%s) = %s, want %s", tt.name, c.Name(), tt.want)
+		}
+	}
+	if _, err := NewCompiler("hhc", ""); err == nil {
+		t.Error("NewCompiler(hhc) did not fail")
+	}
+}
+
+func TestStubCompiler(t *testing.T) {
+	p := NewProject("Go")
+	stub := &StubCompiler{}
+	r, err := stub.Compile(p)
+	if err != nil || r.File != "Go.chm" || r.Failed(SeverityNote) {
+		t.Errorf("Compile() = %+v, %v", r, err)
+	}
+
+	stub = &StubCompiler{
+		Result: &CompileResult{Diagnostics: []*Diagnostic{
+			{Severity: SeverityWarning, Message: "bad tag"},
+			{Severity: SeverityWarning, Message: "bad link"},
+			{Severity: SeverityError, Message: "cannot open"},
+		}},
+		Err: errors.New("failed"),
+	}
+	r, err = stub.Compile(p)
+	if err == nil || len(stub.Projects) != 1 || stub.Projects[0] != "Go" {
+		t.Errorf("Compile() = %v, projects %v", err, stub.Projects)
+	}
+	if r.Count(SeverityWarning) != 2 || r.Count(SeverityError) != 1 || r.Count(SeverityNote) != 0 {
+		t.Errorf("counts %d notes, %d warnings, %d errors", r.Count(SeverityNote), r.Count(SeverityWarning), r.Count(SeverityError))
+	}
+	for _, tt := range []struct {
+		threshold Severity
+		failed    bool
+	}{{SeverityNote, true}, {SeverityWarning, true}, {SeverityError, true}} {
+		if r.Failed(tt.threshold) != tt.failed {
+			t.Errorf("Failed(%s) = %v", tt.threshold, !tt.failed)
+		}
+	}
+	r.Diagnostics = r.Diagnostics[:2]
+	if r.Failed(SeverityError) || !r.Failed(SeverityWarning) {
+		t.Error("Failed with warnings only")
+	}
+}
@@ -0,0 +1,129 @@
+package chm
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Severity is the severity of a compiler diagnostic
+type Severity int
+
+// Severities in increasing order
+const (
+	SeverityNote Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+var severityNames = []string{"note", "warning", "error"}
+
+func (s Severity) String() string {
+	if s >= 0 && int(s) < len(severityNames) {
+		return severityNames[s]
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+// ParseSeverity returns the severity of a name: note, warning or error
+func ParseSeverity(name string) (Severity, error) {
+	for i, n := range severityNames {
+		if strings.EqualFold(name, n) {
+			return Severity(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown severity %s, valid severities are %s", name, strings.Join(severityNames, ", "))
+}
+
+// MarshalText encodes the severity as its name
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes the name of a severity
+func (s *Severity) UnmarshalText(text []byte) error {
+	v, err := ParseSeverity(string(text))
+	*s = v
+	return err
+}
+
+// Diagnostic is a message of a compiler
+type Diagnostic struct {
+	Code     string   `json:"code,omitempty"` // like HHC5003, for hhc.exe
+	Severity Severity `json:"severity"`
+	File     string   `json:"file,omitempty"`
+	Message  string   `json:"message"`
+}
+
+func (d *Diagnostic) String() string {
+	var b strings.Builder
+	if d.Code != "" {
+		b.WriteString(d.Code + ": ")
+	}
+	b.WriteString(d.Severity.String() + ": ")
+	if d.File != "" {
+		b.WriteString(d.File + ": ")
+	}
+	b.WriteString(d.Message)
+	return b.String()
+}
+
+var (
+	// HHC5010: Error: Cannot open "extra.html". Compilation stopped.
+	hhcLineRe = regexp.MustCompile(`^(HHC(\d)\d*)\s*:\s*(?:(?i)(note|warning|error|fatal error)\s*:\s*)?(.*)$`)
+	// Go.hhc : The <OBJECT> tag on line 12 contains no name
+	hhcFileRe = regexp.MustCompile(`^(\S.*?)\s+:\s+(.*)$`)
+	quotedRe  = regexp.MustCompile(`"([^"]+\.\w+)"`)
+	// Warning: ..., file.hhp(12): Error: ... of chmcmd and other tools
+	genericLineRe = regexp.MustCompile(`(?i)^(.*?)\b(note|hint|warning|error|fatal)\s*:\s*(.*)$`)
+)
+
+// parseSeverity returns the severity of a word of a compiler message
+func parseSeverity(word string) Severity {
+	switch strings.ToLower(word) {
+	case "note", "hint":
+		return SeverityNote
+	case "warning":
+		return SeverityWarning
+	}
+	return SeverityError
+}
+
+// ParseLog returns the diagnostics in the output of a compiler. The messages
+// of hhc.exe are recognized by their code, the file is taken from the start of
+// the message or from the first quoted file name. Other lines are diagnostics
+// if they contain a severity followed by a colon.
+func ParseLog(log string) []*Diagnostic {
+	diags := make([]*Diagnostic, 0)
+	s := bufio.NewScanner(strings.NewReader(log))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if m := hhcLineRe.FindStringSubmatch(line); m != nil {
+			d := &Diagnostic{Code: m[1], Message: m[4]}
+			switch {
+			case m[3] != "":
+				d.Severity = parseSeverity(strings.Fields(m[3])[0])
+			case m[2] == "1":
+				d.Severity = SeverityNote
+			case m[2] < "5":
+				d.Severity = SeverityWarning
+			default:
+				d.Severity = SeverityError
+			}
+			if f := hhcFileRe.FindStringSubmatch(d.Message); f != nil {
+				d.File, d.Message = f[1], f[2]
+			} else if f := quotedRe.FindStringSubmatch(d.Message); f != nil {
+				d.File = f[1]
+			}
+			diags = append(diags, d)
+		} else if m := genericLineRe.FindStringSubmatch(line); m != nil {
+			diags = append(diags, &Diagnostic{
+				Severity: parseSeverity(m[2]),
+				File:     strings.TrimRight(strings.TrimSpace(m[1]), ":"),
+				Message:  m[3],
+			})
+		}
+	}
+	return diags
+}
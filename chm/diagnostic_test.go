@@ -0,0 +1,103 @@
+package chm
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseLog(t *testing.T) {
+	tests := []struct {
+		line string
+		want *Diagnostic
+	}{
+		{`HHC5010: Error: Cannot open "extra.html". Compilation stopped.`,
+			&Diagnostic{Code: "HHC5010", Severity: SeverityError, File: "extra.html", Message: `Cannot open "extra.html". Compilation stopped.`}},
+		{`HHC3004: Warning: Go.hhc : The <OBJECT> tag on line 12 contains no name`,
+			&Diagnostic{Code: "HHC3004", Severity: SeverityWarning, File: "Go.hhc", Message: "The <OBJECT> tag on line 12 contains no name"}},
+		{`HHC1003: Compiler information: nothing to compile`,
+			&Diagnostic{Code: "HHC1003", Severity: SeverityNote, Message: "Compiler information: nothing to compile"}},
+		{`HHC3015: An external file was referenced`,
+			&Diagnostic{Code: "HHC3015", Severity: SeverityWarning, Message: "An external file was referenced"}},
+		{`HHC6003: Error: The file Itircl.dll has not been registered correctly.`,
+			&Diagnostic{Code: "HHC6003", Severity: SeverityError, Message: "The file Itircl.dll has not been registered correctly."}},
+		{`HHC5003: Fatal error: Compilation failed while compiling "pkg\fmt\index.html".`,
+			&Diagnostic{Code: "HHC5003", Severity: SeverityError, File: `pkg\fmt\index.html`, Message: `Compilation failed while compiling "pkg\fmt\index.html".`}},
+		{`HHC1002: Note: the file "pkg/index.html" is not in the table of contents`,
+			&Diagnostic{Code: "HHC1002", Severity: SeverityNote, File: "pkg/index.html", Message: `the file "pkg/index.html" is not in the table of contents`}},
+		{`Go.hhp(12): Error: unknown option Foo`,
+			&Diagnostic{Severity: SeverityError, File: "Go.hhp(12)", Message: "unknown option Foo"}},
+		{`  Warning: file not found: a.html`,
+			&Diagnostic{Severity: SeverityWarning, Message: "file not found: a.html"}},
+		{`Hint: the index is empty`,
+			&Diagnostic{Severity: SeverityNote, Message: "the index is empty"}},
+		{`No errors: compilation succeeded`, nil},
+		{`0 Errors, 2 Warnings`, nil},
+		{`Compiling c:\help\Go.chm`, nil},
+		{``, nil},
+	}
+	for _, tt := range tests {
+		got := ParseLog(tt.line)
+		var want []*Diagnostic
+		if tt.want != nil {
+			want = []*Diagnostic{tt.want}
+		}
+		if len(got) != len(want) || len(got) == 1 && !reflect.DeepEqual(got[0], want[0]) {
+			t.Errorf("ParseLog(%q) = %v, want %v", tt.line, got, want)
+		}
+	}
+
+	log := "Microsoft HTML Help Compiler 4.74.8702\r\n\r\nHHC3004: Warning: Go.hhc : bad tag\r\nHHC5010: Error: Cannot open \"a.html\".\r\n"
+	if got := ParseLog(log); len(got) != 2 || got[0].Severity != SeverityWarning || got[1].Severity != SeverityError {
+		t.Errorf("ParseLog of a log = %v", got)
+	}
+}
+
+func TestParseSeverity(t *testing.T) {
+	for _, s := range []Severity{SeverityNote, SeverityWarning, SeverityError} {
+		text, _ := s.MarshalText()
+		var got Severity
+		if err := got.UnmarshalText(text); err != nil || got != s {
+			t.Errorf("UnmarshalText(%s) = %v, %v", text, got, err)
+		}
+	}
+	if _, err := ParseSeverity("fatal"); err == nil {
+		t.Error("ParseSeverity(fatal) did not fail")
+	}
+}
+
+func TestHHWExitCode(t *testing.T) {
+	defer func(f func(string, ...string) (string, int, error)) { runCompiler = f }(runCompiler)
+	tests := []struct {
+		log    string
+		code   int
+		errors int
+	}{
+		// hhc.exe exits with 1 when it succeeds
+		{"Compile time: 0 minutes, 1 second\n", 1, 0},
+		{"", 0, 1},
+		{"HHC5010: Error: Cannot open \"a.html\".\n", 0, 2},
+		{"HHC3004: Warning: Go.hhc : bad tag\n", 1, 0},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		var ran []string
+		runCompiler = func(name string, args ...string) (string, int, error) {
+			ran = append([]string{name}, args...)
+			return tt.log, tt.code, nil
+		}
+		r, err := (&HHW{Dir: dir}).Compile(NewProject("Go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{filepath.Join(dir, "hhc.exe"), "Go.hhp"}; !reflect.DeepEqual(ran, want) {
+			t.Errorf("ran %v, want %v", ran, want)
+		}
+		if n := r.Count(SeverityError); n != tt.errors {
+			t.Errorf("exit code %d with %q: %d errors, want %d", tt.code, tt.log, n, tt.errors)
+		}
+		if r.Failed(SeverityError) != (tt.errors > 0) {
+			t.Errorf("exit code %d with %q: Failed = %v", tt.code, tt.log, r.Failed(SeverityError))
+		}
+	}
+}
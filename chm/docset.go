@@ -0,0 +1,245 @@
+package chm
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DocsetEntry is an entry of the search index of a Dash docset
+type DocsetEntry struct {
+	Name string
+	Type string
+	Path string
+}
+
+// the entry types of the kinds of the index keywords
+var docsetTypes = map[string]string{
+	"package":    "Package",
+	"const":      "Constant",
+	"var":        "Variable",
+	"type":       "Type",
+	"func":       "Function",
+	"method":     "Method",
+	"field":      "Field",
+	"command":    "Command",
+	"document":   "Guide",
+	"production": "Entry",
+	"term":       "Entry",
+}
+
+// the entry types of the images of the tagged toc items
+var docsetImages = map[int]string{
+	17: "Function",
+	19: "Method",
+	35: "Field",
+	37: "Type",
+}
+
+var (
+	// Reader - type in io, Read() - method of Reader in io
+	docsetKeywordRe = regexp.MustCompile(`^(.+)` + regexp.QuoteMeta(IndexSeparator) + `(?:unexported )?(\w+)(?: of (\S+))?`)
+	docsetNameRe    = regexp.MustCompile(`(\w+)\(`)
+)
+
+// DocsetEntries returns the entries of the search index from the index
+// keywords and the tagged items of the table of contents not in the index,
+// like the fields. The methods and fields are named Type.Name.
+func (p *Project) DocsetEntries() []*DocsetEntry {
+	var entries []*DocsetEntry
+	seen := make(map[string]bool)
+	add := func(name, typ, path string) {
+		path = strings.Replace(path, "\\", "/", -1)
+		key := name + "\x00" + typ + "\x00" + path
+		if name == "" || path == "" || strings.Contains(path, "://") || seen[key] {
+			return
+		}
+		seen[key] = true
+		entries = append(entries, &DocsetEntry{name, typ, path})
+	}
+
+	var walkIndex func(i *IndexItem)
+	walkIndex = func(i *IndexItem) {
+		if m := docsetKeywordRe.FindStringSubmatch(i.keyword); m != nil && docsetTypes[m[2]] != "" {
+			name := strings.TrimSuffix(m[1], "()")
+			if m[3] != "" {
+				name = m[3] + "." + name
+			}
+			for _, l := range i.locals {
+				add(name, docsetTypes[m[2]], l.href)
+			}
+		}
+		for _, c := range i.children {
+			walkIndex(c)
+		}
+	}
+	walkIndex(p.index.root)
+
+	var walkToc func(t *TocItem, typeName string)
+	walkToc = func(t *TocItem, typeName string) {
+		// the declarations listed under the source files are not entries
+		if t.image == 11 || t.image == 12 {
+			return
+		}
+		// the odd images are the exported variants
+		typ := docsetImages[t.image-(t.image+1)%2]
+		name := t.label
+		if m := docsetNameRe.FindStringSubmatch(name); m != nil {
+			name = m[1]
+		} else if m := nameRe.FindString(name); m != "" {
+			name = m
+		}
+		switch typ {
+		case "Type":
+			typeName = name
+		case "Method", "Field":
+			if typeName != "" {
+				name = typeName + "." + name
+			}
+		}
+		if typ != "" {
+			add(name, typ, t.href)
+		}
+		for _, c := range t.children {
+			walkToc(c, typeName)
+		}
+	}
+	walkToc(p.toc.root, "")
+	return entries
+}
+
+// SaveDocset saves the project as a Dash docset in a directory named like
+// Go.docset. The files of the project are copied from the current directory
+// into Contents/Resources/Documents with an anchor before the target of each
+// entry so that Dash and Zeal show the table of contents of the page.
+func (p *Project) SaveDocset(dir string) error {
+	fmt.Println("Creating", dir)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	resources := filepath.Join(dir, "Contents", "Resources")
+	docs := filepath.Join(resources, "Documents")
+	entries := p.DocsetEntries()
+
+	anchors := make(map[string][]*DocsetEntry)
+	for _, e := range entries {
+		if i := strings.Index(e.Path, "#"); i > 0 {
+			file := strings.ToLower(e.Path[:i])
+			anchors[file] = append(anchors[file], e)
+		}
+	}
+	for _, f := range p.GetFiles() {
+		f = strings.Replace(f, "\\", "/", -1)
+		data, err := os.ReadFile(filepath.FromSlash(f))
+		if err != nil {
+			return err
+		}
+		if a := anchors[strings.ToLower(f)]; len(a) > 0 {
+			data = insertDashAnchors(data, a)
+		}
+		name := filepath.Join(docs, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(name, data, 0644); err != nil {
+			return err
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "Contents", "Info.plist"), p.infoPlist(), 0644); err != nil {
+		return err
+	}
+
+	db := newSQLiteDB()
+	rows := make([][]interface{}, len(entries))
+	keys := make([][]interface{}, len(entries))
+	for i, e := range entries {
+		rows[i] = []interface{}{nil, e.Name, e.Type, e.Path}
+		keys[i] = []interface{}{e.Name, e.Type, e.Path, int64(i + 1)}
+	}
+	// the keys of the index are compared as bytes
+	sort.Slice(keys, func(i, j int) bool {
+		for k := 0; k < 3; k++ {
+			if x, y := keys[i][k].(string), keys[j][k].(string); x != y {
+				return x < y
+			}
+		}
+		return false
+	})
+	db.addTable("searchIndex", "CREATE TABLE searchIndex(id INTEGER PRIMARY KEY, name TEXT, type TEXT, path TEXT)", rows)
+	db.addIndex("anchor", "searchIndex", "CREATE UNIQUE INDEX anchor ON searchIndex (name, type, path)", keys)
+	f, err := os.Create(filepath.Join(resources, "docSet.dsidx"))
+	if err != nil {
+		return err
+	}
+	if _, err := db.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// insertDashAnchors inserts the Dash anchors of the entries before the
+// elements whose id is the fragment of the entry
+func insertDashAnchors(data []byte, entries []*DocsetEntry) []byte {
+	type insertion struct {
+		pos    int
+		anchor string
+	}
+	var ins []insertion
+	for _, e := range entries {
+		id := e.Path[strings.Index(e.Path, "#")+1:]
+		if u, err := url.PathUnescape(id); err == nil {
+			id = u
+		}
+		i := bytes.Index(data, []byte(` id="`+html.EscapeString(id)+`"`))
+		if i < 0 {
+			continue
+		}
+		if start := bytes.LastIndexByte(data[:i], '<'); start >= 0 {
+			anchor := fmt.Sprintf(`<a name="//apple_ref/cpp/%s/%s" class="dashAnchor"></a>`, e.Type, url.PathEscape(e.Name))
+			ins = append(ins, insertion{start, anchor})
+		}
+	}
+	// inserted from the end so that the positions stay valid, in the order of
+	// the entries at the same position
+	sort.SliceStable(ins, func(i, j int) bool { return ins[i].pos > ins[j].pos })
+	for i := 0; i < len(ins); {
+		j := i
+		var anchors string
+		for ; j < len(ins) && ins[j].pos == ins[i].pos; j++ {
+			anchors += ins[j].anchor
+		}
+		data = append(data[:ins[i].pos], append([]byte(anchors), data[ins[i].pos:]...)...)
+		i = j
+	}
+	return data
+}
+
+// infoPlist returns the Info.plist of the docset
+func (p *Project) infoPlist() []byte {
+	var b Buffer
+	b.Line(`<?xml version="1.0" encoding="UTF-8"?>`)
+	b.Line(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">`)
+	b.Line(`<plist version="1.0">`)
+	b.Indent("<dict>")
+	for _, kv := range [][2]string{
+		{"CFBundleIdentifier", strings.ToLower(p.name)},
+		{"CFBundleName", p.windowOptions["title"]},
+		{"DocSetPlatformFamily", strings.ToLower(p.name)},
+		{"dashIndexFilePath", strings.Replace(p.windowOptions["default_topic"], "\\", "/", -1)},
+		{"DashDocSetFamily", "dashtoc"},
+	} {
+		b.Line("<key>%s</key><string>%s</string>", kv[0], html.EscapeString(kv[1]))
+	}
+	b.Line("<key>isDashDocset</key><true/>")
+	b.Unindent("</dict>")
+	b.Line("</plist>")
+	return b.Bytes()
+}
@@ -0,0 +1,119 @@
+package chm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDocsetEntries(t *testing.T) {
+	tests := []struct {
+		keyword string
+		href    string
+		want    *DocsetEntry
+	}{
+		{"io - package io", "pkg/io/index.html", &DocsetEntry{"io", "Package", "pkg/io/index.html"}},
+		{"Reader - type in io", "pkg/io/index.html#Reader", &DocsetEntry{"Reader", "Type", "pkg/io/index.html#Reader"}},
+		{"Read() - method of Reader in io", "pkg/io/index.html#Reader.Read", &DocsetEntry{"Reader.Read", "Method", "pkg/io/index.html#Reader.Read"}},
+		{"Copy() - func in io", "pkg/io/index.html#Copy", &DocsetEntry{"Copy", "Function", "pkg/io/index.html#Copy"}},
+		{"copyBuffer() - unexported func in io", "pkg/io/index.html#copyBuffer", &DocsetEntry{"copyBuffer", "Function", "pkg/io/index.html#copyBuffer"}},
+		{"EOF - var in io", "pkg/io/index.html#EOF", &DocsetEntry{"EOF", "Variable", "pkg/io/index.html#EOF"}},
+		{"SeekStart - const in io", "pkg/io/index.html#SeekStart", &DocsetEntry{"SeekStart", "Constant", "pkg/io/index.html#SeekStart"}},
+		{"gofmt - command", "cmd/gofmt/index.html", &DocsetEntry{"gofmt", "Command", "cmd/gofmt/index.html"}},
+		{"Go 1.5 - Release Notes - document", `doc\go1.5.html`, &DocsetEntry{"Go 1.5 - Release Notes", "Guide", "doc/go1.5.html"}},
+		{"Expression - production in spec", "ref/spec.html#Expression", &DocsetEntry{"Expression", "Entry", "ref/spec.html#Expression"}},
+		// not entries
+		{"Overview", "pkg/io/index.html#pkg-overview", nil},
+		{"Thing - gadget in io", "pkg/io/index.html#Thing", nil},
+		{"Blog - document", "https://go.dev/blog/", nil},
+		// the same entry from a second keyword
+		{"Reader - type in io", "pkg/io/index.html#Reader", nil},
+	}
+	p := NewProject("Go")
+	root := p.Index().Root()
+	var want []*DocsetEntry
+	for _, tt := range tests {
+		root.Add(tt.keyword).AddLocal(tt.href, tt.keyword)
+		if tt.want != nil {
+			want = append(want, tt.want)
+		}
+	}
+
+	toc := p.Toc().Root()
+	pkg := toc.Add("io", "pkg/io/index.html")
+	// already in the index
+	typ := pkg.Add("Reader", "pkg/io/index.html#Reader")
+	typ.TagAs("type")
+	fields := typ.Add("Fields", "pkg/io/index.html#Reader")
+	field := fields.Add("Size int64", "pkg/io/index.html#Reader.Size")
+	field.TagAs("field")
+	unexported := fields.Add("buf []byte", "pkg/io/index.html#Reader.buf")
+	unexported.TagAs("field")
+	unexported.TagAs("unexported")
+	method := typ.Add("(r *Reader) Len() int", "pkg/io/index.html#Reader.Len")
+	method.TagAs("method")
+	fn := pkg.Add("Pipe() (*PipeReader, *PipeWriter)", "pkg/io/index.html#Pipe")
+	fn.TagAs("function")
+	// the declarations of the source files are not entries
+	file := pkg.Add("io.go", "src/io/io.go.html")
+	file.TagAs("file")
+	decl := file.Add("Copy()", "src/io/io.go.html#L385")
+	decl.TagAs("function")
+	want = append(want,
+		&DocsetEntry{"Reader.Size", "Field", "pkg/io/index.html#Reader.Size"},
+		&DocsetEntry{"Reader.buf", "Field", "pkg/io/index.html#Reader.buf"},
+		&DocsetEntry{"Reader.Len", "Method", "pkg/io/index.html#Reader.Len"},
+		&DocsetEntry{"Pipe", "Function", "pkg/io/index.html#Pipe"},
+	)
+
+	got := p.DocsetEntries()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DocsetEntries() =")
+		for _, e := range got {
+			t.Errorf("\t%+v", *e)
+		}
+		t.Errorf("want")
+		for _, e := range want {
+			t.Errorf("\t%+v", *e)
+		}
+	}
+}
+
+func TestInsertDashAnchors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		entries []*DocsetEntry
+		want    string
+	}{
+		{
+			"single",
+			`<p>x</p><h2 id="Reader">type Reader</h2>`,
+			[]*DocsetEntry{{"Reader", "Type", "a.html#Reader"}},
+			`<p>x</p><a name="//apple_ref/cpp/Type/Reader" class="dashAnchor"></a><h2 id="Reader">type Reader</h2>`,
+		},
+		{
+			"in the order of the entries",
+			`<h3 id="A">A</h3><h3 id="B">B</h3>`,
+			[]*DocsetEntry{{"B", "Type", "a.html#B"}, {"A", "Type", "a.html#A"}, {"A.x", "Field", "a.html#A"}},
+			`<a name="//apple_ref/cpp/Type/A" class="dashAnchor"></a><a name="//apple_ref/cpp/Field/A.x" class="dashAnchor"></a><h3 id="A">A</h3>` +
+				`<a name="//apple_ref/cpp/Type/B" class="dashAnchor"></a><h3 id="B">B</h3>`,
+		},
+		{
+			"escaped",
+			`<h2 id="a&amp;b c">x</h2>`,
+			[]*DocsetEntry{{"Release Notes", "Guide", "a.html#a&b%20c"}},
+			`<a name="//apple_ref/cpp/Guide/Release%20Notes" class="dashAnchor"></a><h2 id="a&amp;b c">x</h2>`,
+		},
+		{
+			"missing id",
+			`<h2 id="Reader">x</h2>`,
+			[]*DocsetEntry{{"Writer", "Type", "a.html#Writer"}},
+			`<h2 id="Reader">x</h2>`,
+		},
+	}
+	for _, tt := range tests {
+		if got := string(insertDashAnchors([]byte(tt.data), tt.entries)); got != tt.want {
+			t.Errorf("%s: insertDashAnchors() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -7,3 +7,13 @@ var ErrUnindent = errors.New("TOC: unindent: root node")
 
 // ErrIndent is returned when doing invalid indent
 var ErrIndent = errors.New("TOC: indent: no parent")
+
+// ErrFormat is returned when reading a file that is not a CHM file
+var ErrFormat = errors.New("CHM: invalid file")
+
+// ErrNotExist is returned when reading a file missing from a CHM file
+var ErrNotExist = errors.New("CHM: file does not exist")
+
+// ErrUnsafeName is returned when extracting a file whose name is absolute or
+// outside the directory
+var ErrUnsafeName = errors.New("CHM: unsafe file name")
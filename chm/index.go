@@ -121,6 +121,16 @@ func (i *IndexItem) AddLocal(href, title string) *Local {
 	return &l
 }
 
+// Merge adds the subkeywords and locals of another keyword recursively
+func (i *IndexItem) Merge(o *IndexItem) {
+	for _, l := range o.locals {
+		i.AddLocal(l.href, l.title)
+	}
+	for _, oc := range o.children {
+		i.Add(oc.keyword).Merge(oc)
+	}
+}
+
 // IsRoot returns true if this is the root node
 func (i *IndexItem) IsRoot() bool {
 	return i.parent == nil
@@ -0,0 +1,261 @@
+package chm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	itsfChunkSize = 0x1000
+	// one quickref entry every 1 + 1<<density entries of a directory chunk
+	itsfDensity      = 2
+	itsfQuickRefStep = 1 + 1<<itsfDensity
+
+	pmglHeaderSize = 0x14
+	pmgiHeaderSize = 0x08
+)
+
+// itsfEntry is a file in the directory of an ITSF container, the offset is
+// relative to the start of its section
+type itsfEntry struct {
+	name    string
+	section int
+	offset  uint64
+	length  uint64
+}
+
+// guidBytes returns the little endian structure of a GUID
+func guidBytes(s string) []byte {
+	h, err := hex.DecodeString(strings.Replace(strings.Trim(s, "{}"), "-", "", -1))
+	if err != nil || len(h) != 16 {
+		panic("invalid guid " + s)
+	}
+	return []byte{h[3], h[2], h[1], h[0], h[5], h[4], h[7], h[6], h[8], h[9], h[10], h[11], h[12], h[13], h[14], h[15]}
+}
+
+// writeEncInt writes a variable length integer, 7 bits per byte with the
+// most significant byte first and the high bit set on all but the last byte
+func writeEncInt(b *bytes.Buffer, v uint64) {
+	var tmp [10]byte
+	i := len(tmp) - 1
+	tmp[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		tmp[i] = byte(v&0x7f) | 0x80
+	}
+	b.Write(tmp[i:])
+}
+
+// compareNames orders the directory entries like the readers search them,
+// ignoring the case of ASCII letters
+func compareNames(a, b string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ca, cb := lowerASCII(a[i]), lowerASCII(b[i])
+		if ca != cb {
+			return int(ca) - int(cb)
+		}
+	}
+	return len(a) - len(b)
+}
+
+func lowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// dirChunk is a directory chunk being filled
+type dirChunk struct {
+	entries bytes.Buffer
+	offsets []int // offsets of the entries from the first entry
+	first   string
+}
+
+// fits returns true if an entry of n bytes fits in the chunk together with
+// the quickref area at the end of the chunk
+func (c *dirChunk) fits(header, n int) bool {
+	count := len(c.offsets) + 1
+	quickref := 2 + 2*((count-1)/itsfQuickRefStep)
+	return header+c.entries.Len()+n+quickref <= itsfChunkSize
+}
+
+func (c *dirChunk) add(name string, entry []byte) {
+	if len(c.offsets) == 0 {
+		c.first = name
+	}
+	c.offsets = append(c.offsets, c.entries.Len())
+	c.entries.Write(entry)
+}
+
+// bytes returns the chunk with its header, the quickref area is written
+// backwards from the end of the chunk and ends with the number of entries
+func (c *dirChunk) bytes(header []byte) []byte {
+	b := make([]byte, itsfChunkSize)
+	copy(b, header)
+	copy(b[len(header):], c.entries.Bytes())
+	n := len(c.offsets)
+	binary.LittleEndian.PutUint16(b[itsfChunkSize-2:], uint16(n))
+	for m := 1; m*itsfQuickRefStep < n; m++ {
+		binary.LittleEndian.PutUint16(b[itsfChunkSize-2-2*m:], uint16(c.offsets[m*itsfQuickRefStep]))
+	}
+	return b
+}
+
+// packChunks fills chunks with the entries in order
+func packChunks(header int, names []string, entries [][]byte) []*dirChunk {
+	chunks := []*dirChunk{{}}
+	for i, e := range entries {
+		c := chunks[len(chunks)-1]
+		if len(c.offsets) > 0 && !c.fits(header, len(e)) {
+			c = &dirChunk{}
+			chunks = append(chunks, c)
+		}
+		c.add(names[i], e)
+	}
+	return chunks
+}
+
+// itsfDirectory returns the listing chunks followed by the index chunks of
+// the entries, the depth of the index tree and the number of its root chunk,
+// -1 without index
+func itsfDirectory(entries []*itsfEntry) (chunks [][]byte, depth int, root int32, listing int) {
+	sort.Slice(entries, func(i, j int) bool { return compareNames(entries[i].name, entries[j].name) < 0 })
+
+	names := make([]string, len(entries))
+	data := make([][]byte, len(entries))
+	for i, e := range entries {
+		var b bytes.Buffer
+		writeEncInt(&b, uint64(len(e.name)))
+		b.WriteString(e.name)
+		writeEncInt(&b, uint64(e.section))
+		writeEncInt(&b, e.offset)
+		writeEncInt(&b, e.length)
+		names[i], data[i] = e.name, b.Bytes()
+	}
+
+	pmgl := packChunks(pmglHeaderSize, names, data)
+	for i, c := range pmgl {
+		var h bytes.Buffer
+		h.WriteString("PMGL")
+		prev, next := int32(i-1), int32(i+1)
+		if i == len(pmgl)-1 {
+			next = -1
+		}
+		for _, v := range []int32{int32(itsfChunkSize - pmglHeaderSize - c.entries.Len()), 0, prev, next} {
+			binary.Write(&h, binary.LittleEndian, v)
+		}
+		chunks = append(chunks, c.bytes(h.Bytes()))
+	}
+	listing, depth, root = len(pmgl), 1, -1
+
+	// each index level lists the first name of the chunks of the level below
+	level := pmgl
+	first := 0
+	for len(level) > 1 {
+		names = names[:0]
+		data = data[:0]
+		for i, c := range level {
+			var b bytes.Buffer
+			writeEncInt(&b, uint64(len(c.first)))
+			b.WriteString(c.first)
+			writeEncInt(&b, uint64(first+i))
+			names, data = append(names, c.first), append(data, b.Bytes())
+		}
+		first = len(chunks)
+		level = packChunks(pmgiHeaderSize, names, data)
+		for _, c := range level {
+			var h bytes.Buffer
+			h.WriteString("PMGI")
+			binary.Write(&h, binary.LittleEndian, int32(itsfChunkSize-pmgiHeaderSize-c.entries.Len()))
+			chunks = append(chunks, c.bytes(h.Bytes()))
+		}
+		depth++
+		root = int32(len(chunks) - 1)
+	}
+	return chunks, depth, root, listing
+}
+
+// writeITSF writes an ITSF container, section0 is the data of the entries of
+// section 0 in order, the data of the other sections is stored in section 0
+// files
+func writeITSF(w io.Writer, entries []*itsfEntry, section0 [][]byte, lang uint32) error {
+	chunks, depth, root, listing := itsfDirectory(entries)
+
+	const (
+		headerSize     = 0x60
+		headerSec0Size = 0x18
+		itspSize       = 0x54
+	)
+	var (
+		dirOffset     = uint64(headerSize + headerSec0Size)
+		dirLength     = uint64(itspSize + len(chunks)*itsfChunkSize)
+		contentOffset = dirOffset + dirLength
+		fileSize      = contentOffset
+		b             bytes.Buffer
+		le            = func(v interface{}) { binary.Write(&b, binary.LittleEndian, v) }
+	)
+
+	for _, data := range section0 {
+		fileSize += uint64(len(data))
+	}
+
+	b.WriteString("ITSF")
+	le(uint32(3))
+	le(uint32(headerSize))
+	le(uint32(1))
+	// the timestamp is left empty so that the same project compiles the same
+	le(uint32(0))
+	le(lang)
+	b.Write(guidBytes("{7C01FD10-7BAA-11D0-9E0C-00A0C922E6EC}"))
+	b.Write(guidBytes("{7C01FD11-7BAA-11D0-9E0C-00A0C922E6EC}"))
+	le(uint64(headerSize))
+	le(uint64(headerSec0Size))
+	le(dirOffset)
+	le(dirLength)
+	le(contentOffset)
+
+	le(uint32(0x01fe))
+	le(uint32(0))
+	le(fileSize)
+	le(uint32(0))
+	le(uint32(0))
+
+	b.WriteString("ITSP")
+	le(uint32(1))
+	le(uint32(itspSize))
+	le(uint32(0x0a))
+	le(uint32(itsfChunkSize))
+	le(uint32(itsfDensity))
+	le(uint32(depth))
+	le(root)
+	le(uint32(0))
+	le(uint32(listing - 1))
+	le(int32(-1))
+	le(uint32(len(chunks)))
+	le(lang)
+	b.Write(guidBytes("{5D02926A-212E-11D0-9DF9-00A0C922E6EC}"))
+	le(uint32(itspSize))
+	le(int32(-1))
+	le(int32(-1))
+	le(int32(-1))
+
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		if _, err := w.Write(c); err != nil {
+			return err
+		}
+	}
+	for _, data := range section0 {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package chm
+
+import "encoding/json"
+
+type tocJSON struct {
+	Label    string     `json:"label"`
+	Href     string     `json:"href,omitempty"`
+	Image    int        `json:"image,omitempty"`
+	Children []*TocItem `json:"children,omitempty"`
+}
+
+// MarshalJSON serializes the item and its children
+func (t *TocItem) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&tocJSON{t.label, t.href, t.image, t.children})
+}
+
+// UnmarshalJSON restores the item and its children
+func (t *TocItem) UnmarshalJSON(data []byte) error {
+	var v tocJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	t.label, t.href, t.image = v.Label, v.Href, v.Image
+	t.children = make([]*TocItem, 0, len(v.Children))
+	for _, c := range v.Children {
+		c.parent = t
+		t.children = append(t.children, c)
+	}
+	return nil
+}
+
+type localJSON struct {
+	Href  string `json:"href"`
+	Title string `json:"title,omitempty"`
+}
+
+type indexJSON struct {
+	Keyword  string       `json:"keyword"`
+	Locals   []localJSON  `json:"locals,omitempty"`
+	Children []*IndexItem `json:"children,omitempty"`
+}
+
+// MarshalJSON serializes the keyword, its locals and its subkeywords
+func (i *IndexItem) MarshalJSON() ([]byte, error) {
+	v := indexJSON{Keyword: i.keyword, Children: i.children}
+	for _, l := range i.locals {
+		v.Locals = append(v.Locals, localJSON{l.href, l.title})
+	}
+	return json.Marshal(&v)
+}
+
+// UnmarshalJSON restores the keyword, its locals and its subkeywords
+func (i *IndexItem) UnmarshalJSON(data []byte) error {
+	var v indexJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*i = *NewIndexItem(v.Keyword, i.parent)
+	for _, l := range v.Locals {
+		i.locals = append(i.locals, &Local{l.Href, l.Title})
+	}
+	for _, c := range v.Children {
+		c.parent = i
+		i.children = append(i.children, c)
+		i.childMap[c.keyword] = c
+	}
+	return nil
+}
+
+type projectJSON struct {
+	Name  string     `json:"name"`
+	Files []string   `json:"files,omitempty"`
+	Toc   *TocItem   `json:"toc"`
+	Index *IndexItem `json:"index"`
+}
+
+// MarshalJSON serializes the files, toc and index of the project, the options
+// and properties are not included
+func (p *Project) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&projectJSON{p.name, p.files, p.toc.root, p.index.root})
+}
+
+// UnmarshalJSON restores the files, toc and index of the project with the
+// default options
+func (p *Project) UnmarshalJSON(data []byte) error {
+	var v projectJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*p = *NewProject(v.Name)
+	p.files = append(p.files, v.Files...)
+	if v.Toc != nil {
+		p.toc.root = v.Toc
+	}
+	if v.Index != nil {
+		p.index.root = v.Index
+	}
+	return nil
+}
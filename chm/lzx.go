@@ -0,0 +1,537 @@
+package chm
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"sort"
+)
+
+const (
+	// lzxFrameSize is the size of an LZX frame, the unit of the reset table
+	lzxFrameSize = 0x8000
+	// lzxResetFrames is the number of frames between two resets of the LZX
+	// state, a reader can only start decoding at a reset
+	lzxResetFrames = 2
+	// lzxWindowFrames is the size of the LZX window in frames
+	lzxWindowFrames = 2
+	// lzxWindowSlots is the number of position slots of the window
+	lzxWindowSlots = 32
+
+	lzxBlockUncompressed = 3
+
+	lzxMinMatch   = 3 // the shortest match searched, LZX allows 2
+	lzxMaxMatch   = 257
+	lzxMaxCodeLen = 16
+	lzxHashBits   = 15
+	lzxMaxChain   = 64
+)
+
+// lzxWriter writes an LZX bit stream, the bits are packed from the most
+// significant bit into 16 bit little endian words
+type lzxWriter struct {
+	buf  bytes.Buffer
+	bits uint32
+	n    uint
+}
+
+func (w *lzxWriter) writeBits(v uint32, n uint) {
+	for n > 0 {
+		m := 16 - w.n
+		if m > n {
+			m = n
+		}
+		w.bits = w.bits<<m | (v>>(n-m))&(1<<m-1)
+		w.n += m
+		n -= m
+		if w.n == 16 {
+			w.buf.WriteByte(byte(w.bits))
+			w.buf.WriteByte(byte(w.bits >> 8))
+			w.bits, w.n = 0, 0
+		}
+	}
+}
+
+// align pads the bit stream to the next 16 bit word, a stream that is already
+// aligned is padded with a whole word
+func (w *lzxWriter) align() {
+	w.writeBits(0, 16-w.n)
+}
+
+// flushWord pads the bits of the current word, like a reader at the end of a
+// frame
+func (w *lzxWriter) flushWord() {
+	if w.n > 0 {
+		w.writeBits(0, 16-w.n)
+	}
+}
+
+// lzxToken is a literal when length is 0, otherwise a match
+type lzxToken struct {
+	length int
+	offset int
+	lit    byte
+}
+
+// lzxSymbol is a coded token of a verbatim block
+type lzxSymbol struct {
+	main      uint16
+	length    int16 // the length footer, -1 if none
+	extraBits uint8
+	extra     uint32
+}
+
+// lzxEncoder compresses the data written into an LZX stream of verbatim
+// blocks, one block per frame. A frame that does not compress is stored in
+// an uncompressed block. The data is compressed one reset interval at a time
+// so that only the stream is kept in memory.
+type lzxEncoder struct {
+	w       lzxWriter
+	data    []byte // the pending data of the current reset interval
+	offsets []uint64
+	length  int
+
+	head []int32
+	prev []int32
+}
+
+func newLZXEncoder() *lzxEncoder {
+	return &lzxEncoder{
+		data: make([]byte, 0, lzxResetFrames*lzxFrameSize),
+		head: make([]int32, 1<<lzxHashBits),
+		prev: make([]int32, lzxResetFrames*lzxFrameSize),
+	}
+}
+
+// Write adds data to the stream
+func (e *lzxEncoder) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		m := copy(e.data[len(e.data):cap(e.data)], p)
+		e.data = e.data[:len(e.data)+m]
+		p = p[m:]
+		if len(e.data) == cap(e.data) {
+			e.compressInterval()
+		}
+	}
+	e.length += n
+	return n, nil
+}
+
+// Len returns the number of bytes written
+func (e *lzxEncoder) Len() int { return e.length }
+
+// Close compresses the pending data and returns the stream and the offset of
+// every frame in it
+func (e *lzxEncoder) Close() ([]byte, []uint64) {
+	if len(e.data) > 0 {
+		e.compressInterval()
+	}
+	return e.w.buf.Bytes(), e.offsets
+}
+
+func lzxHash(b []byte) int {
+	return int((uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])) * 2654435761 >> (32 - lzxHashBits))
+}
+
+// insert adds the position to the hash chains
+func (e *lzxEncoder) insert(pos int) {
+	if pos+lzxMinMatch <= len(e.data) {
+		h := lzxHash(e.data[pos:])
+		e.prev[pos] = e.head[h]
+		e.head[h] = int32(pos)
+	}
+}
+
+// longestMatch returns the longest match at pos shorter than max bytes
+func (e *lzxEncoder) longestMatch(pos, max int) (length, offset int) {
+	if max < lzxMinMatch || pos+lzxMinMatch > len(e.data) {
+		return 0, 0
+	}
+	d := e.data
+	cand := e.head[lzxHash(d[pos:])]
+	for chain := 0; cand >= 0 && chain < lzxMaxChain; chain++ {
+		c := int(cand)
+		// the largest offset of the window is its size minus 3
+		if pos-c > lzxWindowFrames*lzxFrameSize-3 {
+			break
+		}
+		if d[c+length] == d[pos+length] {
+			n := 0
+			for n < max && d[c+n] == d[pos+n] {
+				n++
+			}
+			if n > length {
+				length, offset = n, pos-c
+				if n == max {
+					break
+				}
+			}
+		}
+		cand = e.prev[c]
+	}
+	if length < lzxMinMatch {
+		return 0, 0
+	}
+	return length, offset
+}
+
+// tokens returns the literals and matches of a frame of the interval, a match
+// does not cross the end of the frame
+func (e *lzxEncoder) tokens(start, end int) []lzxToken {
+	tokens := make([]lzxToken, 0, (end-start)/2)
+	for pos := start; pos < end; {
+		max := end - pos
+		if max > lzxMaxMatch {
+			max = lzxMaxMatch
+		}
+		length, offset := e.longestMatch(pos, max)
+		e.insert(pos)
+		if length > 0 && length < max {
+			// a longer match at the next byte is taken instead
+			if next, _ := e.longestMatch(pos+1, max-1); next > length {
+				length = 0
+			}
+		}
+		if length == 0 {
+			tokens = append(tokens, lzxToken{lit: e.data[pos]})
+			pos++
+			continue
+		}
+		tokens = append(tokens, lzxToken{length: length, offset: offset})
+		for i := pos + 1; i < pos+length; i++ {
+			e.insert(i)
+		}
+		pos += length
+	}
+	return tokens
+}
+
+// lzxPositionSlot returns the position slot of a formatted offset
+func lzxPositionSlot(f uint32) int {
+	slot := sort.Search(lzxWindowSlots, func(i int) bool { return lzxPositionBase[i] > f })
+	return slot - 1
+}
+
+// compressInterval compresses the pending data, a reset interval
+func (e *lzxEncoder) compressInterval() {
+	for i := range e.head {
+		e.head[i] = -1
+	}
+	var (
+		r           = [3]uint32{1, 1, 1}
+		mainLens    = make([]byte, lzxMainLiterals+lzxWindowSlots*8)
+		lengthLens  = make([]byte, lzxLengthSize)
+		mainFreq    = make([]int, len(mainLens))
+		lengthFreq  = make([]int, len(lengthLens))
+		newMain     = make([]byte, len(mainLens))
+		newLength   = make([]byte, len(lengthLens))
+		firstHeader = true
+	)
+	for start := 0; start < len(e.data); start += lzxFrameSize {
+		end := start + lzxFrameSize
+		if end > len(e.data) {
+			end = len(e.data)
+		}
+		e.offsets = append(e.offsets, uint64(e.w.buf.Len()))
+		if firstHeader {
+			// no intel E8 call translation
+			e.w.writeBits(0, 1)
+			firstHeader = false
+		}
+
+		// code the tokens with a copy of the repeated offsets, kept if the
+		// block is verbatim
+		rr := r
+		syms := make([]lzxSymbol, 0, end-start)
+		for i := range mainFreq {
+			mainFreq[i] = 0
+		}
+		for i := range lengthFreq {
+			lengthFreq[i] = 0
+		}
+		for _, t := range e.tokens(start, end) {
+			if t.length == 0 {
+				syms = append(syms, lzxSymbol{main: uint16(t.lit), length: -1})
+				mainFreq[t.lit]++
+				continue
+			}
+			s := lzxSymbol{length: -1}
+			var slot int
+			switch uint32(t.offset) {
+			case rr[0]:
+				slot = 0
+			case rr[1]:
+				slot = 1
+				rr[0], rr[1] = rr[1], rr[0]
+			case rr[2]:
+				slot = 2
+				rr[0], rr[2] = rr[2], rr[0]
+			default:
+				f := uint32(t.offset) + 2
+				slot = lzxPositionSlot(f)
+				s.extraBits = uint8(lzxExtraBits[slot])
+				s.extra = f - lzxPositionBase[slot]
+				rr[0], rr[1], rr[2] = uint32(t.offset), rr[0], rr[1]
+			}
+			header := t.length - 2
+			if header > 7 {
+				header = 7
+			}
+			if header == 7 {
+				s.length = int16(t.length - 2 - 7)
+				lengthFreq[s.length]++
+			}
+			s.main = uint16(lzxMainLiterals + slot*8 + header)
+			mainFreq[s.main]++
+			syms = append(syms, s)
+		}
+
+		huffmanLengths(mainFreq, lzxMaxCodeLen, newMain)
+		huffmanLengths(lengthFreq, lzxMaxCodeLen, newLength)
+		mainPre := lzxPretree(mainLens[:lzxMainLiterals], newMain[:lzxMainLiterals])
+		mainPre2 := lzxPretree(mainLens[lzxMainLiterals:], newMain[lzxMainLiterals:])
+		lengthPre := lzxPretree(lengthLens, newLength)
+
+		bits := mainPre.cost() + mainPre2.cost() + lengthPre.cost()
+		for i, f := range mainFreq {
+			bits += f * int(newMain[i])
+		}
+		for i, f := range lengthFreq {
+			bits += f * int(newLength[i])
+		}
+		for _, s := range syms {
+			bits += int(s.extraBits)
+		}
+		if bits >= 8*(end-start)+16+12*8 {
+			e.w.writeBits(lzxBlockUncompressed, 3)
+			e.w.writeBits(uint32(end-start)>>8, 16)
+			e.w.writeBits(uint32(end-start)&0xff, 8)
+			e.w.align()
+			for _, v := range r {
+				binary.Write(&e.w.buf, binary.LittleEndian, v)
+			}
+			e.w.buf.Write(e.data[start:end])
+			if (end-start)%2 == 1 {
+				e.w.buf.WriteByte(0)
+			}
+			continue
+		}
+
+		e.w.writeBits(lzxBlockVerbatim, 3)
+		e.w.writeBits(uint32(end-start)>>8, 16)
+		e.w.writeBits(uint32(end-start)&0xff, 8)
+		mainPre.write(&e.w)
+		mainPre2.write(&e.w)
+		lengthPre.write(&e.w)
+		mainCodes := huffmanCodes(newMain)
+		lengthCodes := huffmanCodes(newLength)
+		for _, s := range syms {
+			e.w.writeBits(uint32(mainCodes[s.main]), uint(newMain[s.main]))
+			if s.length >= 0 {
+				e.w.writeBits(uint32(lengthCodes[s.length]), uint(newLength[s.length]))
+			}
+			if s.extraBits > 0 {
+				e.w.writeBits(s.extra, uint(s.extraBits))
+			}
+		}
+		e.w.flushWord()
+		r = rr
+		copy(mainLens, newMain)
+		copy(lengthLens, newLength)
+	}
+	e.data = e.data[:0]
+}
+
+// lzxPretreeCode is the code lengths of a tree encoded with the pretree
+type lzxPretreeCode struct {
+	lens  []byte // of the pretree
+	syms  []byte
+	extra []byte // the run length of the symbols 17 and 18
+}
+
+// lzxPretree encodes the code lengths of a tree as deltas from the lengths
+// of the previous block, runs of zeros are encoded with the symbols 17 and 18
+func lzxPretree(prev, lens []byte) *lzxPretreeCode {
+	c := &lzxPretreeCode{lens: make([]byte, lzxPretreeSize)}
+	freq := make([]int, lzxPretreeSize)
+	for x := 0; x < len(lens); {
+		run := 0
+		for x+run < len(lens) && lens[x+run] == 0 && run < 51 {
+			run++
+		}
+		switch {
+		case run >= 20:
+			c.syms = append(c.syms, 18)
+			c.extra = append(c.extra, byte(run-20))
+		case run >= 4:
+			c.syms = append(c.syms, 17)
+			c.extra = append(c.extra, byte(run-4))
+		default:
+			run = 1
+			c.syms = append(c.syms, byte((int(prev[x])-int(lens[x])+17)%17))
+			c.extra = append(c.extra, 0)
+		}
+		freq[c.syms[len(c.syms)-1]]++
+		x += run
+	}
+	huffmanLengths(freq, 15, c.lens)
+	return c
+}
+
+// cost returns the size of the code in bits
+func (c *lzxPretreeCode) cost() int {
+	bits := 4 * lzxPretreeSize
+	for _, s := range c.syms {
+		bits += int(c.lens[s])
+		switch s {
+		case 17:
+			bits += 4
+		case 18:
+			bits += 5
+		}
+	}
+	return bits
+}
+
+func (c *lzxPretreeCode) write(w *lzxWriter) {
+	for _, l := range c.lens {
+		w.writeBits(uint32(l), 4)
+	}
+	codes := huffmanCodes(c.lens)
+	for i, s := range c.syms {
+		w.writeBits(uint32(codes[s]), uint(c.lens[s]))
+		switch s {
+		case 17:
+			w.writeBits(uint32(c.extra[i]), 4)
+		case 18:
+			w.writeBits(uint32(c.extra[i]), 5)
+		}
+	}
+}
+
+// huffmanNode is a node of the tree built by huffmanLengths
+type huffmanNode struct {
+	freq        int
+	sym         int // -1 for an inner node
+	left, right *huffmanNode
+}
+
+type huffmanHeap []*huffmanNode
+
+func (h huffmanHeap) Len() int { return len(h) }
+func (h huffmanHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].sym < h[j].sym
+}
+func (h huffmanHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *huffmanHeap) Push(x interface{}) { *h = append(*h, x.(*huffmanNode)) }
+func (h *huffmanHeap) Pop() interface{} {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// huffmanLengths sets the code lengths of the symbols from their frequencies,
+// no longer than max bits. The frequencies are halved until the code fits.
+func huffmanLengths(freq []int, max uint, lens []byte) {
+	f := append([]int(nil), freq...)
+	for {
+		for i := range lens {
+			lens[i] = 0
+		}
+		var h huffmanHeap
+		for sym, n := range f {
+			if n > 0 {
+				h = append(h, &huffmanNode{freq: n, sym: sym})
+			}
+		}
+		switch len(h) {
+		case 0:
+			return
+		case 1:
+			// a code needs two symbols to be complete, the unused neighbour gets
+			// the other code like with hhc.exe
+			partner := h[0].sym + 1
+			if partner == len(lens) {
+				partner = h[0].sym - 1
+			}
+			lens[h[0].sym], lens[partner] = 1, 1
+			return
+		}
+		heap.Init(&h)
+		for h.Len() > 1 {
+			a := heap.Pop(&h).(*huffmanNode)
+			b := heap.Pop(&h).(*huffmanNode)
+			heap.Push(&h, &huffmanNode{freq: a.freq + b.freq, sym: -1, left: a, right: b})
+		}
+		longest := uint(0)
+		var walk func(n *huffmanNode, depth uint)
+		walk = func(n *huffmanNode, depth uint) {
+			if n.sym >= 0 {
+				lens[n.sym] = byte(depth)
+				if depth > longest {
+					longest = depth
+				}
+				return
+			}
+			walk(n.left, depth+1)
+			walk(n.right, depth+1)
+		}
+		walk(h[0], 0)
+		if longest <= max {
+			return
+		}
+		for i, n := range f {
+			if n > 0 {
+				f[i] = (n + 1) / 2
+			}
+		}
+	}
+}
+
+// huffmanCodes returns the canonical codes of the code lengths, assigned like
+// huffman.build
+func huffmanCodes(lens []byte) []uint16 {
+	codes := make([]uint16, len(lens))
+	code := 0
+	for l := byte(1); l <= lzxMaxCodeLen; l++ {
+		for sym, sl := range lens {
+			if sl == l {
+				codes[sym] = uint16(code)
+				code++
+			}
+		}
+		code <<= 1
+	}
+	return codes
+}
+
+// lzxControlData returns the ::DataSpace/Storage/MSCompressed/ControlData file
+func lzxControlData() []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, uint32(6))
+	b.WriteString("LZXC")
+	for _, v := range []uint32{2, lzxResetFrames, lzxWindowFrames, 1, 0} {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	return b.Bytes()
+}
+
+// lzxResetTable returns the reset table file of an LZX stream
+func lzxResetTable(uncompressed, compressed int, offsets []uint64) []byte {
+	var b bytes.Buffer
+	for _, v := range []uint32{2, uint32(len(offsets)), 8, 0x28} {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	for _, v := range []uint64{uint64(uncompressed), uint64(compressed), lzxFrameSize} {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	for _, v := range offsets {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	return b.Bytes()
+}
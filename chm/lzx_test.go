@@ -0,0 +1,102 @@
+package chm
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestHuffmanBuild(t *testing.T) {
+	tests := []struct {
+		lens []byte
+		ok   bool
+	}{
+		{[]byte{1, 1}, true},
+		{[]byte{1, 2, 0, 2}, true},
+		{[]byte{0, 0, 0}, true}, // empty
+		{[]byte{1}, false},
+		{[]byte{0, 1, 0}, false},
+		{[]byte{2, 2, 2}, false},
+		{[]byte{1, 1, 1}, false},
+		{[]byte{1, 2, 2, 2}, false},
+	}
+	for _, tt := range tests {
+		h := &huffman{lens: tt.lens}
+		if err := h.build(); (err == nil) != tt.ok {
+			t.Errorf("build(%v) = %v", tt.lens, err)
+		}
+	}
+}
+
+// TestHuffmanLengthsSingleSymbol checks that the codes of the trees with a
+// single used symbol are complete, they are rejected by libmspack otherwise
+func TestHuffmanLengthsSingleSymbol(t *testing.T) {
+	for _, sym := range []int{0, 1, 100, 255} {
+		freq := make([]int, 256)
+		freq[sym] = 7
+		lens := make([]byte, 256)
+		huffmanLengths(freq, 16, lens)
+		if lens[sym] == 0 {
+			t.Errorf("symbol %d has no code", sym)
+		}
+		if err := (&huffman{lens: lens}).build(); err != nil {
+			t.Errorf("single symbol %d: %v", sym, err)
+		}
+	}
+
+	prev := make([]byte, 256)
+	for i := range prev {
+		prev[i] = byte(1 + i%8)
+	}
+	// 5 runs of 51 zeros
+	zero := make([]byte, 255)
+	for name, c := range map[string]*lzxPretreeCode{
+		"empty tree":     lzxPretree(zero, zero),
+		"unchanged tree": lzxPretree(prev, prev),
+	} {
+		if err := (&huffman{lens: c.lens}).build(); err != nil {
+			t.Errorf("pretree of the %s: %v", name, err)
+		}
+	}
+}
+
+func TestLZXSingleSymbolTrees(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	frame := make([]byte, lzxFrameSize)
+	for i := range frame {
+		frame[i] = "abcdefghijklmnop"[r.Intn(16)]
+	}
+	files := map[string][]byte{
+		"index.html": []byte("<html><title>Index</title></html>"),
+		// a main tree with a single literal
+		"a.txt": []byte("a"),
+		// the trees of the second block only have zero deltas
+		"same.txt": append(append([]byte(nil), frame...), frame...),
+		// no match after the first frame and an empty length tree
+		"zero.bin": make([]byte, 2*lzxFrameSize+1),
+	}
+	_, data := writeTestCHM(t, files)
+	cr, err := NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range files {
+		got, err := cr.ReadFile("/" + name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: read %d bytes, want %d", name, len(got), len(want))
+		}
+	}
+
+	// a single file of one byte is the only content of the section
+	_, data = writeTestCHM(t, map[string][]byte{"index.html": []byte("a")})
+	cr, err = NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := cr.ReadFile("/index.html"); err != nil || string(got) != "a" {
+		t.Errorf("index.html = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,524 @@
+package chm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	lzxBlockVerbatim = 1
+	lzxBlockAligned  = 2
+
+	lzxPretreeSize  = 20
+	lzxAlignedSize  = 8
+	lzxLengthSize   = 249
+	lzxMainLiterals = 256
+)
+
+var (
+	errLZXData = errors.New("CHM: invalid LZX data")
+
+	// number of extra bits and base offset of the position slots
+	lzxExtraBits    [51]uint
+	lzxPositionBase [51]uint32
+)
+
+func init() {
+	j := uint(0)
+	for i := 0; i < len(lzxExtraBits); i += 2 {
+		lzxExtraBits[i] = j
+		if i+1 < len(lzxExtraBits) {
+			lzxExtraBits[i+1] = j
+		}
+		if i != 0 && j < 17 {
+			j++
+		}
+	}
+	base := uint32(0)
+	for i := range lzxPositionBase {
+		lzxPositionBase[i] = base
+		base += 1 << lzxExtraBits[i]
+	}
+}
+
+// lzxBitReader reads the bits of 16 bit little endian words from the most
+// significant bit, past the end of the data it reads zeros
+type lzxBitReader struct {
+	data []byte
+	pos  int
+	buf  uint64
+	n    uint
+}
+
+func (r *lzxBitReader) ensure(n uint) {
+	for r.n < n {
+		var w uint64
+		if r.pos+1 < len(r.data) {
+			w = uint64(binary.LittleEndian.Uint16(r.data[r.pos:]))
+		}
+		r.pos += 2
+		r.buf = r.buf<<16 | w
+		r.n += 16
+	}
+}
+
+func (r *lzxBitReader) peek(n uint) uint32 {
+	r.ensure(n)
+	return uint32(r.buf>>(r.n-n)) & (1<<n - 1)
+}
+
+func (r *lzxBitReader) skip(n uint) {
+	r.n -= n
+	r.buf &= 1<<r.n - 1
+}
+
+func (r *lzxBitReader) read(n uint) uint32 {
+	if n == 0 {
+		return 0
+	}
+	v := r.peek(n)
+	r.skip(n)
+	return v
+}
+
+// align drops the bits left of the current word
+func (r *lzxBitReader) align() {
+	r.skip(r.n % 16)
+}
+
+// reset drops the buffered bits, the next read starts at pos
+func (r *lzxBitReader) reset() {
+	r.buf, r.n = 0, 0
+}
+
+// overrun returns true if the reader has read past the end of the data
+func (r *lzxBitReader) overrun() bool {
+	return r.pos-int(r.n/8) > len(r.data)
+}
+
+// huffman is a canonical Huffman code decoded by looking up the next bits of
+// the longest code
+type huffman struct {
+	lens  []byte
+	table []uint16
+	bits  uint
+}
+
+// build creates the lookup table from the code lengths. Like libmspack, an
+// incomplete or over-subscribed code is rejected and an empty code only fails
+// when a symbol is decoded.
+func (h *huffman) build() error {
+	h.bits = 0
+	for _, l := range h.lens {
+		if uint(l) > h.bits {
+			h.bits = uint(l)
+		}
+	}
+	if h.bits == 0 {
+		h.table = nil
+		return nil
+	}
+	size := 1 << h.bits
+	if cap(h.table) >= size {
+		h.table = h.table[:size]
+	} else {
+		h.table = make([]uint16, size)
+	}
+	code := 0
+	for l := uint(1); l <= h.bits; l++ {
+		for sym, sl := range h.lens {
+			if uint(sl) != l {
+				continue
+			}
+			first := code << (h.bits - l)
+			last := (code + 1) << (h.bits - l)
+			if last > size {
+				return errLZXData
+			}
+			for i := first; i < last; i++ {
+				h.table[i] = uint16(sym)
+			}
+			code++
+		}
+		code <<= 1
+	}
+	if code != 2<<h.bits {
+		return errLZXData
+	}
+	return nil
+}
+
+func (h *huffman) decode(r *lzxBitReader) (int, error) {
+	if h.table == nil {
+		return 0, errLZXData
+	}
+	sym := h.table[r.peek(h.bits)]
+	r.skip(uint(h.lens[sym]))
+	return int(sym), nil
+}
+
+// lzxDecoder decodes the frames of an LZX stream as stored in a CHM file,
+// without the LZX DELTA extensions
+type lzxDecoder struct {
+	in     lzxBitReader
+	window []byte
+	// frames between two resets of the state
+	resetFrames int
+	slots       int
+
+	windowPos, framePos int
+	frame               int
+	out                 []byte
+	length              int // uncompressed length of the stream
+
+	r0, r1, r2     uint32
+	headerRead     bool
+	blockType      int
+	blockLength    int
+	blockRemaining int
+	intelFileSize  int32
+	intelCurPos    int32
+	intelStarted   bool
+
+	pretree, mainTree, lengthTree, alignedTree huffman
+}
+
+// newLZXDecoder creates a decoder of a stream decoding to length bytes, the
+// window size and the reset interval are in bytes
+func newLZXDecoder(data []byte, windowSize, resetInterval, length int) (*lzxDecoder, error) {
+	slots := map[int]int{15: 30, 16: 32, 17: 34, 18: 36, 19: 38, 20: 42, 21: 50}
+	bits := 0
+	for 1<<bits < windowSize {
+		bits++
+	}
+	n, ok := slots[bits]
+	if !ok || 1<<bits != windowSize || resetInterval%lzxFrameSize != 0 {
+		return nil, fmt.Errorf("CHM: unsupported LZX window size %d or reset interval %d", windowSize, resetInterval)
+	}
+	d := &lzxDecoder{
+		in:          lzxBitReader{data: data},
+		window:      make([]byte, windowSize),
+		resetFrames: resetInterval / lzxFrameSize,
+		slots:       n,
+		out:         make([]byte, 0, length),
+		length:      length,
+	}
+	d.pretree.lens = make([]byte, lzxPretreeSize)
+	d.mainTree.lens = make([]byte, lzxMainLiterals+n*8)
+	d.lengthTree.lens = make([]byte, lzxLengthSize)
+	d.alignedTree.lens = make([]byte, lzxAlignedSize)
+	return d, nil
+}
+
+// resetState resets the state at the start of a reset interval
+func (d *lzxDecoder) resetState() {
+	d.r0, d.r1, d.r2 = 1, 1, 1
+	d.headerRead = false
+	d.blockRemaining = 0
+	d.blockType = 0
+	d.intelCurPos = 0
+	d.intelStarted = false
+	for i := range d.mainTree.lens {
+		d.mainTree.lens[i] = 0
+	}
+	for i := range d.lengthTree.lens {
+		d.lengthTree.lens[i] = 0
+	}
+}
+
+// readLengths reads the code lengths first to last of a tree, encoded with the
+// pretree as deltas from the lengths of the previous block
+func (d *lzxDecoder) readLengths(lens []byte, first, last int) error {
+	for i := range d.pretree.lens {
+		d.pretree.lens[i] = byte(d.in.read(4))
+	}
+	if err := d.pretree.build(); err != nil {
+		return err
+	}
+	delta := func(x, z int) byte {
+		z = int(lens[x]) - z
+		if z < 0 {
+			z += 17
+		}
+		return byte(z)
+	}
+	for x := first; x < last; {
+		z, err := d.pretree.decode(&d.in)
+		if err != nil {
+			return err
+		}
+		var (
+			run int
+			v   byte
+		)
+		switch z {
+		case 17:
+			run = int(d.in.read(4)) + 4
+		case 18:
+			run = int(d.in.read(5)) + 20
+		case 19:
+			run = int(d.in.read(1)) + 4
+			z, err := d.pretree.decode(&d.in)
+			if err != nil {
+				return err
+			}
+			v = delta(x, z)
+		default:
+			run, v = 1, delta(x, z)
+		}
+		if x+run > last {
+			return errLZXData
+		}
+		for ; run > 0; run-- {
+			lens[x] = v
+			x++
+		}
+	}
+	return nil
+}
+
+// readBlockHeader starts a new block
+func (d *lzxDecoder) readBlockHeader() error {
+	if d.blockType == lzxBlockUncompressed && d.blockLength&1 == 1 {
+		d.in.pos++
+	}
+	d.blockType = int(d.in.read(3))
+	hi := d.in.read(16)
+	lo := d.in.read(8)
+	d.blockLength = int(hi<<8 | lo)
+	d.blockRemaining = d.blockLength
+
+	switch d.blockType {
+	case lzxBlockAligned, lzxBlockVerbatim:
+		if d.blockType == lzxBlockAligned {
+			for i := range d.alignedTree.lens {
+				d.alignedTree.lens[i] = byte(d.in.read(3))
+			}
+			if err := d.alignedTree.build(); err != nil {
+				return err
+			}
+		}
+		if err := d.readLengths(d.mainTree.lens, 0, lzxMainLiterals); err != nil {
+			return err
+		}
+		if err := d.readLengths(d.mainTree.lens, lzxMainLiterals, len(d.mainTree.lens)); err != nil {
+			return err
+		}
+		if err := d.mainTree.build(); err != nil {
+			return err
+		}
+		if d.mainTree.lens[0xe8] != 0 {
+			d.intelStarted = true
+		}
+		if err := d.readLengths(d.lengthTree.lens, 0, lzxLengthSize); err != nil {
+			return err
+		}
+		return d.lengthTree.build()
+	case lzxBlockUncompressed:
+		d.intelStarted = true
+		// the header is followed by 1 to 16 bits of padding, the rest of the
+		// last word read
+		if d.in.n == 0 {
+			d.in.ensure(16)
+		}
+		d.in.reset()
+		if d.in.pos+12 > len(d.in.data) {
+			return errLZXData
+		}
+		d.r0 = binary.LittleEndian.Uint32(d.in.data[d.in.pos:])
+		d.r1 = binary.LittleEndian.Uint32(d.in.data[d.in.pos+4:])
+		d.r2 = binary.LittleEndian.Uint32(d.in.data[d.in.pos+8:])
+		d.in.pos += 12
+		return nil
+	}
+	return fmt.Errorf("CHM: invalid LZX block type %d", d.blockType)
+}
+
+// decodeMatches decodes the symbols of a compressed block into the window
+// until n bytes have been written, the last match may write more
+func (d *lzxDecoder) decodeMatches(n int) (int, error) {
+	mask := len(d.window) - 1
+	for n > 0 {
+		sym, err := d.mainTree.decode(&d.in)
+		if err != nil {
+			return n, err
+		}
+		if sym < lzxMainLiterals {
+			d.window[d.windowPos] = byte(sym)
+			d.windowPos++
+			n--
+			continue
+		}
+		sym -= lzxMainLiterals
+		length := sym & 7
+		if length == 7 {
+			footer, err := d.lengthTree.decode(&d.in)
+			if err != nil {
+				return n, err
+			}
+			length += footer
+		}
+		length += 2
+
+		var offset uint32
+		switch slot := sym >> 3; slot {
+		case 0:
+			offset = d.r0
+		case 1:
+			offset = d.r1
+			d.r1 = d.r0
+			d.r0 = offset
+		case 2:
+			offset = d.r2
+			d.r2 = d.r0
+			d.r0 = offset
+		default:
+			extra := lzxExtraBits[slot]
+			offset = lzxPositionBase[slot] - 2
+			if d.blockType == lzxBlockAligned && extra >= 3 {
+				offset += d.in.read(extra-3) << 3
+				aligned, err := d.alignedTree.decode(&d.in)
+				if err != nil {
+					return n, err
+				}
+				offset += uint32(aligned)
+			} else {
+				offset += d.in.read(extra)
+			}
+			d.r2, d.r1, d.r0 = d.r1, d.r0, offset
+		}
+
+		if int(offset) > len(d.window) || d.windowPos+length > len(d.window) {
+			return n, errLZXData
+		}
+		for i := 0; i < length; i++ {
+			d.window[d.windowPos] = d.window[(d.windowPos-int(offset))&mask]
+			d.windowPos++
+		}
+		n -= length
+	}
+	return n, nil
+}
+
+// decodeFrame decodes the next frame and appends it to the output
+func (d *lzxDecoder) decodeFrame() error {
+	if d.resetFrames > 0 && d.frame%d.resetFrames == 0 {
+		if d.blockRemaining > 0 {
+			return errLZXData
+		}
+		d.resetState()
+	}
+	if !d.headerRead {
+		if d.in.read(1) == 1 {
+			hi := d.in.read(16)
+			lo := d.in.read(16)
+			d.intelFileSize = int32(hi<<16 | lo)
+		} else {
+			d.intelFileSize = 0
+		}
+		d.headerRead = true
+	}
+
+	frameSize := lzxFrameSize
+	if rest := d.length - len(d.out); rest < frameSize {
+		frameSize = rest
+	}
+	todo := d.framePos + frameSize - d.windowPos
+	for todo > 0 {
+		if d.blockRemaining == 0 {
+			if err := d.readBlockHeader(); err != nil {
+				return err
+			}
+		}
+		run := d.blockRemaining
+		if run > todo {
+			run = todo
+		}
+		todo -= run
+		d.blockRemaining -= run
+
+		switch d.blockType {
+		case lzxBlockVerbatim, lzxBlockAligned:
+			over, err := d.decodeMatches(run)
+			if err != nil {
+				return err
+			}
+			// a match may continue past the end of the frame
+			if over < 0 {
+				if -over > d.blockRemaining {
+					return errLZXData
+				}
+				d.blockRemaining += over
+				todo += over
+			}
+		case lzxBlockUncompressed:
+			if d.in.pos+run > len(d.in.data) {
+				return errLZXData
+			}
+			copy(d.window[d.windowPos:], d.in.data[d.in.pos:d.in.pos+run])
+			d.in.pos += run
+			d.windowPos += run
+		}
+	}
+	if d.in.overrun() {
+		return errLZXData
+	}
+	d.in.align()
+
+	frame := d.window[d.framePos : d.framePos+frameSize]
+	if d.intelStarted && d.intelFileSize != 0 && d.frame < 32768 && frameSize > 10 {
+		frame = append([]byte(nil), frame...)
+		d.translateE8(frame)
+	} else if d.intelFileSize != 0 {
+		d.intelCurPos += int32(frameSize)
+	}
+	d.out = append(d.out, frame...)
+
+	d.frame++
+	d.framePos += frameSize
+	if d.framePos == len(d.window) {
+		d.framePos = 0
+	}
+	if d.windowPos == len(d.window) {
+		d.windowPos = 0
+	}
+	return nil
+}
+
+// translateE8 undoes the conversion of the relative x86 CALL offsets into
+// absolute offsets
+func (d *lzxDecoder) translateE8(frame []byte) {
+	pos := d.intelCurPos
+	for i := 0; i < len(frame)-10; {
+		if frame[i] != 0xe8 {
+			i++
+			pos++
+			continue
+		}
+		abs := int32(binary.LittleEndian.Uint32(frame[i+1:]))
+		if abs >= -pos && abs < d.intelFileSize {
+			rel := abs - pos
+			if abs < 0 {
+				rel = abs + d.intelFileSize
+			}
+			binary.LittleEndian.PutUint32(frame[i+1:], uint32(rel))
+		}
+		i += 5
+		pos += 5
+	}
+	d.intelCurPos += int32(len(frame))
+}
+
+// decode decodes the stream until at least n bytes are available
+func (d *lzxDecoder) decode(n int) ([]byte, error) {
+	if n > d.length {
+		return nil, errLZXData
+	}
+	for len(d.out) < n {
+		if err := d.decodeFrame(); err != nil {
+			return nil, err
+		}
+	}
+	return d.out, nil
+}
@@ -1,10 +1,8 @@
 package chm
 
 import (
-	"io"
+	"fmt"
 	"log"
-	"os"
-	"os/exec"
 	"regexp"
 	"sort"
 	"strings"
@@ -90,6 +88,14 @@ func (p *Project) AddFile(filename string) {
 	p.files = append(p.files, filename)
 }
 
+// Merge adds the files and index of another project and places its toc under
+// the given item
+func (p *Project) Merge(o *Project, toc *TocItem) {
+	p.files = append(p.files, o.files...)
+	toc.Merge(o.toc.root)
+	p.index.root.Merge(o.index.root)
+}
+
 // Empty returns true of the project has no file
 func (p *Project) Empty() bool {
 	return len(p.files) == 0
@@ -112,8 +118,14 @@ func (p *Project) GetFiles() []string {
 // Serialize serializes the project
 func (p *Project) Serialize(b *Buffer) {
 	b.Line("[OPTIONS]")
-	for k, v := range p.options {
-		if v != "" {
+	// sorted so that the same project always serializes the same
+	keys := make([]string, 0, len(p.options))
+	for k := range p.options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v := p.options[k]; v != "" {
 			b.Line("%s=%s", k, v)
 		}
 	}
@@ -187,8 +199,7 @@ func (p *Project) Save() {
 
 // Open opens the project in HTML Help Workshop
 func (p *Project) Open() error {
-	c := exec.Command(`"C:\Program Files (x86)\HTML Help Workshop\hhw.exe"`, p.name+".hhp")
-	return c.Run()
+	return (&HHW{}).Open(p)
 }
 
 // MustOpen opens the project in HTML Help Workshop
@@ -198,27 +209,19 @@ func (p *Project) MustOpen() {
 	}
 }
 
-// Compile compiles the project
+// Compile compiles the project with HTML Help Workshop, or with the native
+// compiler when it is not installed, and fails if the compiler reports an
+// error
 func (p *Project) Compile() error {
-	c := exec.Command(`C:\Program Files (x86)\HTML Help Workshop\hhc.exe`, p.name+".hhp")
-	stdout, err := c.StdoutPipe()
-	if err != nil {
-		return err
-	}
-	stderr, err := c.StderrPipe()
+	c, err := NewCompiler("auto", "")
 	if err != nil {
 		return err
 	}
-	if err := c.Start(); err != nil {
-		return err
-	}
-	if _, err := io.Copy(os.Stdout, stdout); err != nil {
-		return err
-	}
-	if _, err := io.Copy(os.Stderr, stderr); err != nil {
-		return err
+	r, err := c.Compile(p)
+	if err == nil && r.Failed(SeverityError) {
+		err = fmt.Errorf("compiling %s failed with %d errors", p.name+".hhp", r.Count(SeverityError))
 	}
-	return c.Wait()
+	return err
 }
 
 // MustCompile compies the project
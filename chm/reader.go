@@ -0,0 +1,319 @@
+package chm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// File is a file stored in a compiled CHM file
+type File struct {
+	Name    string
+	Section int
+	Offset  uint64
+	Length  uint64
+}
+
+// Internal returns true for the files written by the compiler, like the
+// directories, #SYSTEM or the ::DataSpace storage
+func (f *File) Internal() bool {
+	return !strings.HasPrefix(f.Name, "/") || strings.HasSuffix(f.Name, "/") ||
+		strings.HasPrefix(f.Name, "/#") || strings.HasPrefix(f.Name, "/$")
+}
+
+// Reader reads the files of a compiled CHM file
+type Reader struct {
+	// Files are the files in the order of the directory
+	Files []*File
+
+	r       io.ReaderAt
+	closer  io.Closer
+	content int64 // offset of section 0
+	byName  map[string]*File
+	lzx     *lzxDecoder
+}
+
+// OpenReader opens a compiled CHM file
+func OpenReader(name string) (*Reader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r, err := NewReader(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.closer = f
+	return r, nil
+}
+
+// NewReader reads the directory of a CHM file of the given size
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	header := make([]byte, 0x60)
+	if size < int64(len(header)) {
+		return nil, ErrFormat
+	}
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != "ITSF" {
+		return nil, ErrFormat
+	}
+	version := binary.LittleEndian.Uint32(header[4:])
+	dirOffset := int64(binary.LittleEndian.Uint64(header[0x48:]))
+	dirLength := int64(binary.LittleEndian.Uint64(header[0x50:]))
+	content := dirOffset + dirLength
+	if version >= 3 {
+		content = int64(binary.LittleEndian.Uint64(header[0x58:]))
+	}
+	if dirOffset < 0 || dirLength < 0x54 || dirOffset+dirLength > size || content > size {
+		return nil, ErrFormat
+	}
+
+	dir := make([]byte, dirLength)
+	if _, err := r.ReadAt(dir, dirOffset); err != nil {
+		return nil, err
+	}
+	if string(dir[:4]) != "ITSP" {
+		return nil, ErrFormat
+	}
+	itsp := int64(binary.LittleEndian.Uint32(dir[8:]))
+	chunkSize := int64(binary.LittleEndian.Uint32(dir[0x10:]))
+	chunks := int64(binary.LittleEndian.Uint32(dir[0x2c:]))
+	if chunkSize < 0x20 || itsp+chunks*chunkSize > dirLength {
+		return nil, ErrFormat
+	}
+
+	cr := &Reader{r: r, content: content, byName: make(map[string]*File)}
+	for i := int64(0); i < chunks; i++ {
+		chunk := dir[itsp+i*chunkSize : itsp+(i+1)*chunkSize]
+		if string(chunk[:4]) != "PMGL" {
+			continue
+		}
+		end := chunkSize - int64(binary.LittleEndian.Uint32(chunk[4:]))
+		if end < pmglHeaderSize || end > chunkSize {
+			return nil, ErrFormat
+		}
+		entries := bytes.NewReader(chunk[pmglHeaderSize:end])
+		for entries.Len() > 0 {
+			f, err := readDirEntry(entries)
+			if err != nil {
+				return nil, err
+			}
+			cr.Files = append(cr.Files, f)
+			cr.byName[strings.ToLower(f.Name)] = f
+		}
+	}
+	return cr, nil
+}
+
+// readEncInt reads a variable length integer of the directory
+func readEncInt(r io.ByteReader) (uint64, error) {
+	var v uint64
+	for i := 0; i < 10; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, ErrFormat
+		}
+		v = v<<7 | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return 0, ErrFormat
+}
+
+func readDirEntry(r *bytes.Reader) (*File, error) {
+	n, err := readEncInt(r)
+	if err != nil || n > uint64(r.Len()) {
+		return nil, ErrFormat
+	}
+	name := make([]byte, n)
+	r.Read(name)
+	f := &File{Name: string(name)}
+	var section uint64
+	for _, v := range []*uint64{&section, &f.Offset, &f.Length} {
+		if *v, err = readEncInt(r); err != nil {
+			return nil, err
+		}
+	}
+	f.Section = int(section)
+	return f, nil
+}
+
+// Close closes the file opened by OpenReader
+func (r *Reader) Close() error {
+	if r.closer != nil {
+		return r.closer.Close()
+	}
+	return nil
+}
+
+// Lookup returns a file by name ignoring case, the names start with a slash
+func (r *Reader) Lookup(name string) *File {
+	return r.byName[strings.ToLower(name)]
+}
+
+// ReadFile returns the content of a file by name
+func (r *Reader) ReadFile(name string) ([]byte, error) {
+	f := r.Lookup(name)
+	if f == nil {
+		return nil, ErrNotExist
+	}
+	return r.Read(f)
+}
+
+// Read returns the content of a file
+func (r *Reader) Read(f *File) ([]byte, error) {
+	switch f.Section {
+	case 0:
+		data := make([]byte, f.Length)
+		if _, err := r.r.ReadAt(data, r.content+int64(f.Offset)); err != nil {
+			return nil, err
+		}
+		return data, nil
+	case 1:
+		if r.lzx == nil {
+			if err := r.openSection(); err != nil {
+				return nil, err
+			}
+		}
+		out, err := r.lzx.decode(int(f.Offset + f.Length))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), out[f.Offset:f.Offset+f.Length]...), nil
+	}
+	return nil, ErrFormat
+}
+
+// openSection creates the decoder of the LZX compressed section from its
+// control data and reset table
+func (r *Reader) openSection() error {
+	content, err := r.ReadFile(lzxStorage + "Content")
+	if err != nil {
+		return err
+	}
+	control, err := r.ReadFile(lzxStorage + "ControlData")
+	if err != nil {
+		return err
+	}
+	table, err := r.ReadFile(lzxStorage + "Transform/" + lzxTransformGUID + "/InstanceData/ResetTable")
+	if err != nil {
+		return err
+	}
+	if len(control) < 20 || string(control[4:8]) != "LZXC" || len(table) < 0x28 {
+		return ErrFormat
+	}
+	resetInterval := int(binary.LittleEndian.Uint32(control[12:]))
+	windowSize := int(binary.LittleEndian.Uint32(control[16:]))
+	if binary.LittleEndian.Uint32(control[8:]) == 2 {
+		resetInterval *= lzxFrameSize
+		windowSize *= lzxFrameSize
+	}
+	length := int(binary.LittleEndian.Uint64(table[0x10:]))
+	r.lzx, err = newLZXDecoder(content, windowSize, resetInterval, length)
+	return err
+}
+
+// System is the decoded #SYSTEM file
+type System struct {
+	Version         uint32
+	ContentsFile    string
+	IndexFile       string
+	DefaultTopic    string
+	Title           string
+	Language        uint32
+	DefaultWindow   string
+	CompiledFile    string
+	CompilerVersion string
+	// Records are the data of every record by code
+	Records map[uint16][]byte
+}
+
+// System decodes the #SYSTEM file
+func (r *Reader) System() (*System, error) {
+	data, err := r.ReadFile("/#SYSTEM")
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, ErrFormat
+	}
+	s := &System{Version: binary.LittleEndian.Uint32(data), Records: make(map[uint16][]byte)}
+	str := func(b []byte) string {
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+		return string(b)
+	}
+	for p := 4; p+4 <= len(data); {
+		code := binary.LittleEndian.Uint16(data[p:])
+		n := int(binary.LittleEndian.Uint16(data[p+2:]))
+		if p+4+n > len(data) {
+			return nil, ErrFormat
+		}
+		rec := data[p+4 : p+4+n]
+		s.Records[code] = rec
+		switch code {
+		case 0:
+			s.ContentsFile = str(rec)
+		case 1:
+			s.IndexFile = str(rec)
+		case 2:
+			s.DefaultTopic = str(rec)
+		case 3:
+			s.Title = str(rec)
+		case 4:
+			if len(rec) >= 4 {
+				s.Language = binary.LittleEndian.Uint32(rec)
+			}
+		case 5:
+			s.DefaultWindow = str(rec)
+		case 6:
+			s.CompiledFile = str(rec)
+		case 9:
+			s.CompilerVersion = str(rec)
+		}
+		p += 4 + n
+	}
+	return s, nil
+}
+
+// Extract writes the files of the CHM file that are not internal into a
+// directory. It fails with ErrUnsafeName before writing anything if a name is
+// absolute or leads outside the directory.
+func (r *Reader) Extract(dir string) error {
+	for _, f := range r.Files {
+		if !f.Internal() && !filepath.IsLocal(filepath.FromSlash(strings.TrimPrefix(f.Name, "/"))) {
+			return fmt.Errorf("%w: %s", ErrUnsafeName, f.Name)
+		}
+	}
+	for _, f := range r.Files {
+		if f.Internal() {
+			continue
+		}
+		data, err := r.Read(f)
+		if err != nil {
+			return err
+		}
+		name := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(f.Name, "/")))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(name, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
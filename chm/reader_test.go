@@ -0,0 +1,140 @@
+package chm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestCHM saves the files in a temporary directory, adds them to a
+// project and returns the compiled file
+func writeTestCHM(t *testing.T, files map[string][]byte) (*Project, []byte) {
+	t.Chdir(t.TempDir())
+	p := NewProject("Test")
+	for name, data := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		p.AddFile(name)
+		p.Toc().Root().Add(name, name)
+	}
+	p.SetStartFile("index.html")
+	var b bytes.Buffer
+	if err := p.WriteCHM(&b); err != nil {
+		t.Fatal(err)
+	}
+	return p, b.Bytes()
+}
+
+func TestReaderRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	span := make([]byte, 3*lzxFrameSize+17)
+	for i := range span {
+		// compressible but not only repetitions
+		span[i] = "abcdefgh"[r.Intn(8)]
+	}
+	files := map[string][]byte{
+		"index.html": []byte("<html><head><title>Start &amp; index</title></head></html>"),
+		"odd.html":   bytes.Repeat([]byte("odd"), 4115),
+		"span.txt":   span,
+	}
+	// enough names for several listing chunks and an index chunk
+	for i := 0; i < 400; i++ {
+		name := fmt.Sprintf("pkg/a_rather_long_package_directory_name_%03d/index.html", i)
+		files[name] = []byte(fmt.Sprintf("<html><title>%d</title>%s</html>", i, bytes.Repeat([]byte{byte('a' + i%26)}, i)))
+	}
+	if len(files["odd.html"])%2 != 1 {
+		t.Fatal("odd.html has an even length")
+	}
+
+	_, data := writeTestCHM(t, files)
+	dirOffset := binary.LittleEndian.Uint64(data[0x48:])
+	if depth := binary.LittleEndian.Uint32(data[dirOffset+0x18:]); depth < 2 {
+		t.Errorf("directory depth is %d, want an index chunk", depth)
+	}
+
+	cr, err := NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// read from the end so that the decoder does not only go forward
+	names := []string{"span.txt", "odd.html", "index.html", "pkg/a_rather_long_package_directory_name_399/index.html"}
+	for name := range files {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		got, err := cr.ReadFile("/" + name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, files[name]) {
+			t.Errorf("%s: read %d bytes, want %d", name, len(got), len(files[name]))
+		}
+	}
+	if f := cr.Lookup("/INDEX.HTML"); f == nil || f.Section != 1 {
+		t.Errorf("Lookup ignoring case = %v", f)
+	}
+	if _, err := cr.ReadFile("/missing.html"); err != ErrNotExist {
+		t.Errorf("missing file: %v, want ErrNotExist", err)
+	}
+	for _, name := range []string{"/Test.hhc", "/Test.hhk", "/#TOPICS", "/#STRINGS", "/#WINDOWS"} {
+		if cr.Lookup(name) == nil {
+			t.Errorf("%s is missing", name)
+		}
+	}
+
+	sys, err := cr.System()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type fields struct {
+		contents, index, topic, title, compiled string
+		lang                                    uint32
+	}
+	got := fields{sys.ContentsFile, sys.IndexFile, sys.DefaultTopic, sys.Title, sys.CompiledFile, sys.Language}
+	want := fields{"Test.hhc", "Test.hhk", "index.html", "Test", "Test", 0x409}
+	if got != want {
+		t.Errorf("System() = %+v, want %+v", got, want)
+	}
+}
+
+func TestNewReaderInvalid(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("ITSF"), bytes.Repeat([]byte{0}, 0x100)} {
+		if _, err := NewReader(bytes.NewReader(data), int64(len(data))); err != ErrFormat {
+			t.Errorf("NewReader(%d bytes) = %v, want ErrFormat", len(data), err)
+		}
+	}
+}
+
+func TestExtractUnsafeName(t *testing.T) {
+	for _, name := range []string{"/../evil.txt", "/a/../../evil.txt", "//evil.txt"} {
+		dir := t.TempDir()
+		var b bytes.Buffer
+		entries := []*itsfEntry{{name: "/"}, {name: "/ok.txt", length: 2}, {name: name, offset: 2, length: 4}}
+		if err := writeITSF(&b, entries, [][]byte{[]byte("ok"), []byte("evil")}, 0x409); err != nil {
+			t.Fatal(err)
+		}
+		cr, err := NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := filepath.Join(dir, "out")
+		if err := cr.Extract(out); !errors.Is(err, ErrUnsafeName) {
+			t.Errorf("Extract with %s = %v, want ErrUnsafeName", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "evil.txt")); err == nil {
+			t.Errorf("Extract with %s wrote outside the directory", name)
+		}
+		if _, err := os.Stat(filepath.Join(out, "ok.txt")); err == nil {
+			t.Errorf("Extract with %s wrote files before failing", name)
+		}
+	}
+}
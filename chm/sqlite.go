@@ -0,0 +1,289 @@
+package chm
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// The search index of a docset is an SQLite database. Only a new database
+// with tables of text and integer columns and their indexes is needed, so it
+// is written directly in the SQLite file format instead of requiring cgo.
+
+const (
+	sqlitePageSize = 4096
+	// the version number of SQLite written in the header
+	sqliteVersion = 3040001
+
+	// b-tree page types
+	sqliteIndexInterior = 0x02
+	sqliteTableInterior = 0x05
+	sqliteIndexLeaf     = 0x0a
+	sqliteTableLeaf     = 0x0d
+
+	// the largest payload stored in a table leaf cell, the rest is stored in
+	// overflow pages
+	sqliteTableMaxLocal = sqlitePageSize - 35
+	sqliteIndexMaxLocal = (sqlitePageSize-12)*64/255 - 23
+	sqliteMinLocal      = (sqlitePageSize-12)*32/255 - 23
+)
+
+// sqliteDB builds a database file page by page
+type sqliteDB struct {
+	// pages[n] is the page number n+1
+	pages  [][]byte
+	schema [][]byte
+}
+
+func newSQLiteDB() *sqliteDB {
+	db := &sqliteDB{}
+	// page 1 is the schema table, written last
+	db.newPage()
+	return db
+}
+
+func (db *sqliteDB) newPage() (uint32, []byte) {
+	page := make([]byte, sqlitePageSize)
+	db.pages = append(db.pages, page)
+	return uint32(len(db.pages)), page
+}
+
+// sqliteVarint appends a variable length integer, values up to 2^56
+func sqliteVarint(b []byte, v uint64) []byte {
+	var tmp [9]byte
+	n := len(tmp)
+	for {
+		n--
+		tmp[n] = byte(v & 0x7f)
+		if n < len(tmp)-1 {
+			tmp[n] |= 0x80
+		}
+		v >>= 7
+		if v == 0 {
+			break
+		}
+	}
+	return append(b, tmp[n:]...)
+}
+
+// sqliteRecord encodes the values of a row, nil, int64 or string
+func sqliteRecord(values ...interface{}) []byte {
+	var types, body []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			types = sqliteVarint(types, 0)
+		case int64:
+			switch {
+			case v == 0:
+				types = sqliteVarint(types, 8)
+			case v == 1:
+				types = sqliteVarint(types, 9)
+			default:
+				// serial types 1 to 6 store 1, 2, 3, 4, 6 and 8 bytes
+				sizes := []int{1, 2, 3, 4, 6, 8}
+				t := 0
+				for sizes[t] < 8 && (v < -1<<(8*sizes[t]-1) || v >= 1<<(8*sizes[t]-1)) {
+					t++
+				}
+				types = sqliteVarint(types, uint64(t+1))
+				var b [8]byte
+				binary.BigEndian.PutUint64(b[:], uint64(v))
+				body = append(body, b[8-sizes[t]:]...)
+			}
+		case string:
+			types = sqliteVarint(types, uint64(len(v))*2+13)
+			body = append(body, v...)
+		default:
+			panic("sqlite: unsupported value")
+		}
+	}
+	// the header size includes itself
+	size := len(types) + 1
+	if size > 0x7f {
+		size++
+	}
+	record := sqliteVarint(nil, uint64(size))
+	record = append(record, types...)
+	return append(record, body...)
+}
+
+// payload returns the part of a payload stored in a cell followed by the
+// number of its first overflow page, the rest is written in overflow pages
+func (db *sqliteDB) payload(p []byte, maxLocal int) []byte {
+	if len(p) <= maxLocal {
+		return p
+	}
+	local := sqliteMinLocal + (len(p)-sqliteMinLocal)%(sqlitePageSize-4)
+	if local > maxLocal {
+		local = sqliteMinLocal
+	}
+	cell := append([]byte(nil), p[:local]...)
+	rest := p[local:]
+	first, page := db.newPage()
+	cell = binary.BigEndian.AppendUint32(cell, first)
+	for {
+		n := copy(page[4:], rest)
+		rest = rest[n:]
+		if len(rest) == 0 {
+			return cell
+		}
+		next, nextPage := db.newPage()
+		binary.BigEndian.PutUint32(page, next)
+		page = nextPage
+	}
+}
+
+// writePage writes the cells of a b-tree page at the given header offset,
+// right is the right-most child of an interior page
+func writePage(page []byte, offset int, kind byte, cells [][]byte, right uint32) {
+	header := 8
+	if kind == sqliteIndexInterior || kind == sqliteTableInterior {
+		header = 12
+		binary.BigEndian.PutUint32(page[offset+8:], right)
+	}
+	page[offset] = kind
+	binary.BigEndian.PutUint16(page[offset+3:], uint16(len(cells)))
+	end := len(page)
+	for i, c := range cells {
+		end -= len(c)
+		copy(page[end:], c)
+		binary.BigEndian.PutUint16(page[offset+header+2*i:], uint16(end))
+	}
+	binary.BigEndian.PutUint16(page[offset+5:], uint16(end))
+}
+
+func (db *sqliteDB) page(kind byte, cells [][]byte, right uint32) uint32 {
+	n, page := db.newPage()
+	writePage(page, 0, kind, cells, right)
+	return n
+}
+
+// leaves writes the cells in leaf pages. The cell after each page is returned
+// as divider when removed is true, like in an index where every key is stored
+// once, the dividers are otherwise given by divider.
+func (db *sqliteDB) leaves(kind byte, cells [][]byte, removed bool, divider func(last int) []byte) ([]uint32, [][]byte) {
+	if len(cells) == 0 {
+		return []uint32{db.page(kind, nil, 0)}, nil
+	}
+	var pages []uint32
+	var dividers [][]byte
+	for start := 0; start < len(cells); {
+		i, size := start, 8
+		for i < len(cells) && size+2+len(cells[i]) <= sqlitePageSize {
+			size += 2 + len(cells[i])
+			i++
+		}
+		if !removed {
+			pages = append(pages, db.page(kind, cells[start:i], 0))
+			dividers = append(dividers, divider(i-1))
+			start = i
+			continue
+		}
+		// a removed divider must be followed by a page
+		if i == len(cells)-1 {
+			i--
+		}
+		pages = append(pages, db.page(kind, cells[start:i], 0))
+		if i < len(cells) {
+			dividers = append(dividers, cells[i])
+		}
+		start = i + 1
+	}
+	return pages, dividers
+}
+
+// interior writes the interior pages above the children and returns the root
+// page. The cell of children[i] is its page number followed by dividers[i],
+// the divider of the right-most child of a page moves to the level above.
+func (db *sqliteDB) interior(kind byte, children []uint32, dividers [][]byte) uint32 {
+	for len(children) > 1 {
+		var upChildren []uint32
+		var upDividers [][]byte
+		for start := 0; start < len(children); {
+			i, size := start, 12
+			for i+1 < len(children) && size+6+len(dividers[i]) <= sqlitePageSize {
+				size += 6 + len(dividers[i])
+				i++
+			}
+			// the last page needs a cell besides its right-most child
+			if i+1 == len(children)-1 && i > start+1 {
+				i--
+			}
+			cells := make([][]byte, 0, i-start)
+			for j := start; j < i; j++ {
+				cells = append(cells, append(binary.BigEndian.AppendUint32(nil, children[j]), dividers[j]...))
+			}
+			upChildren = append(upChildren, db.page(kind, cells, children[i]))
+			if i < len(dividers) {
+				upDividers = append(upDividers, dividers[i])
+			}
+			start = i + 1
+		}
+		children, dividers = upChildren, upDividers
+	}
+	return children[0]
+}
+
+// addTable adds a table whose rows are given in the order of their rowid,
+// starting at 1
+func (db *sqliteDB) addTable(name, sql string, rows [][]interface{}) {
+	cells := make([][]byte, len(rows))
+	for i, row := range rows {
+		p := sqliteRecord(row...)
+		c := sqliteVarint(nil, uint64(len(p)))
+		c = sqliteVarint(c, uint64(i+1))
+		cells[i] = append(c, db.payload(p, sqliteTableMaxLocal)...)
+	}
+	leaves, dividers := db.leaves(sqliteTableLeaf, cells, false, func(last int) []byte {
+		return sqliteVarint(nil, uint64(last+1))
+	})
+	root := db.interior(sqliteTableInterior, leaves, dividers)
+	db.schema = append(db.schema, sqliteRecord("table", name, name, int64(root), sql))
+}
+
+// addIndex adds an index of a table whose keys, the indexed values followed
+// by the rowid, are sorted
+func (db *sqliteDB) addIndex(name, table, sql string, keys [][]interface{}) {
+	cells := make([][]byte, len(keys))
+	for i, key := range keys {
+		p := sqliteRecord(key...)
+		cells[i] = append(sqliteVarint(nil, uint64(len(p))), db.payload(p, sqliteIndexMaxLocal)...)
+	}
+	leaves, dividers := db.leaves(sqliteIndexLeaf, cells, true, nil)
+	root := db.interior(sqliteIndexInterior, leaves, dividers)
+	db.schema = append(db.schema, sqliteRecord("index", name, table, int64(root), sql))
+}
+
+// WriteTo writes the database file, the schema must fit in the first page
+func (db *sqliteDB) WriteTo(w io.Writer) (int64, error) {
+	page := db.pages[0]
+	cells := make([][]byte, len(db.schema))
+	for i, r := range db.schema {
+		c := sqliteVarint(nil, uint64(len(r)))
+		c = sqliteVarint(c, uint64(i+1))
+		cells[i] = append(c, r...)
+	}
+	writePage(page, 100, sqliteTableLeaf, cells, 0)
+
+	copy(page, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(page[16:], sqlitePageSize)
+	page[18], page[19] = 1, 1 // legacy journal
+	page[21], page[22], page[23] = 64, 32, 32
+	binary.BigEndian.PutUint32(page[24:], 1) // change counter
+	binary.BigEndian.PutUint32(page[28:], uint32(len(db.pages)))
+	binary.BigEndian.PutUint32(page[40:], 1) // schema cookie
+	binary.BigEndian.PutUint32(page[44:], 4) // schema format
+	binary.BigEndian.PutUint32(page[56:], 1) // UTF-8
+	binary.BigEndian.PutUint32(page[92:], 1) // version valid for
+	binary.BigEndian.PutUint32(page[96:], sqliteVersion)
+
+	var n int64
+	for _, p := range db.pages {
+		m, err := w.Write(p)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
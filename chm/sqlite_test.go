@@ -0,0 +1,233 @@
+package chm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// sqliteFile reads the b-trees of a database written by sqliteDB
+type sqliteFile struct {
+	t    *testing.T
+	data []byte
+}
+
+func (f *sqliteFile) page(n uint32) []byte {
+	if n == 0 || int(n)*sqlitePageSize > len(f.data) {
+		f.t.Fatalf("page %d out of the file", n)
+	}
+	return f.data[(n-1)*sqlitePageSize : n*sqlitePageSize]
+}
+
+func readSQLiteVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 8; i++ {
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return v<<8 | uint64(b[8]), 9
+}
+
+// payload returns the payload of size n starting at the cell data b,
+// following the overflow pages
+func (f *sqliteFile) payload(b []byte, n, maxLocal int) []byte {
+	if n <= maxLocal {
+		return b[:n]
+	}
+	local := sqliteMinLocal + (n-sqliteMinLocal)%(sqlitePageSize-4)
+	if local > maxLocal {
+		local = sqliteMinLocal
+	}
+	p := append([]byte(nil), b[:local]...)
+	for next := binary.BigEndian.Uint32(b[local:]); len(p) < n; {
+		page := f.page(next)
+		m := n - len(p)
+		if m > sqlitePageSize-4 {
+			m = sqlitePageSize - 4
+		}
+		p = append(p, page[4:4+m]...)
+		next = binary.BigEndian.Uint32(page)
+	}
+	return p
+}
+
+// walk visits the rowids and records of a table, or the keys of an index, in
+// order
+func (f *sqliteFile) walk(n uint32, visit func(rowid uint64, record []byte)) {
+	page := f.page(n)
+	header := 0
+	if n == 1 {
+		header = 100
+	}
+	kind := page[header]
+	cells := int(binary.BigEndian.Uint16(page[header+3:]))
+	ptrs := header + 8
+	if kind == sqliteIndexInterior || kind == sqliteTableInterior {
+		ptrs += 4
+		if cells == 0 {
+			f.t.Errorf("interior page %d has no cell", n)
+		}
+	}
+	for i := 0; i < cells; i++ {
+		c := page[binary.BigEndian.Uint16(page[ptrs+2*i:]):]
+		switch kind {
+		case sqliteTableLeaf:
+			size, m := readSQLiteVarint(c)
+			rowid, k := readSQLiteVarint(c[m:])
+			visit(rowid, f.payload(c[m+k:], int(size), sqliteTableMaxLocal))
+		case sqliteTableInterior:
+			f.walk(binary.BigEndian.Uint32(c), visit)
+		case sqliteIndexLeaf:
+			size, m := readSQLiteVarint(c)
+			visit(0, f.payload(c[m:], int(size), sqliteIndexMaxLocal))
+		case sqliteIndexInterior:
+			f.walk(binary.BigEndian.Uint32(c), visit)
+			size, m := readSQLiteVarint(c[4:])
+			visit(0, f.payload(c[4+m:], int(size), sqliteIndexMaxLocal))
+		default:
+			f.t.Fatalf("page %d has the type %d", n, kind)
+		}
+	}
+	if kind == sqliteIndexInterior || kind == sqliteTableInterior {
+		f.walk(binary.BigEndian.Uint32(page[header+8:]), visit)
+	}
+}
+
+// decodeSQLiteRecord returns the values of a record, nil, int64 or string
+func decodeSQLiteRecord(t *testing.T, r []byte) []interface{} {
+	size, n := readSQLiteVarint(r)
+	body := r[size:]
+	var values []interface{}
+	for h := r[n:size]; len(h) > 0; {
+		typ, m := readSQLiteVarint(h)
+		h = h[m:]
+		switch {
+		case typ == 0:
+			values = append(values, nil)
+		case typ == 8 || typ == 9:
+			values = append(values, int64(typ-8))
+		case typ >= 1 && typ <= 6:
+			size := []int{1, 2, 3, 4, 6, 8}[typ-1]
+			v := int64(int8(body[0]))
+			for _, b := range body[1:size] {
+				v = v<<8 | int64(b)
+			}
+			values = append(values, v)
+			body = body[size:]
+		case typ >= 13 && typ%2 == 1:
+			size := int(typ-13) / 2
+			values = append(values, string(body[:size]))
+			body = body[size:]
+		default:
+			t.Fatalf("serial type %d", typ)
+		}
+	}
+	return values
+}
+
+func TestSQLiteRecord(t *testing.T) {
+	for _, v := range []int64{0, 1, 2, -1, 127, 128, -129, 40000, 1 << 20, -1 << 30, 1 << 40, 1<<62 + 5} {
+		got := decodeSQLiteRecord(t, sqliteRecord(nil, v, "text"))
+		if want := []interface{}{nil, v, "text"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("record of %d = %v", v, got)
+		}
+	}
+	long := make([]interface{}, 100)
+	for i := range long {
+		long[i] = fmt.Sprint(i)
+	}
+	if got := decodeSQLiteRecord(t, sqliteRecord(long...)); !reflect.DeepEqual(got, long) {
+		t.Errorf("record with a two byte header = %v", got)
+	}
+}
+
+func TestSQLiteDB(t *testing.T) {
+	const n = 5000
+	rows := make([][]interface{}, n)
+	keys := make([][]interface{}, n)
+	for i := range rows {
+		name := fmt.Sprintf("Name%05d%s", (i*7919)%n, strings.Repeat("x", i%40))
+		path := fmt.Sprintf("pkg/p%d/index.html#%s", i%50, name)
+		if i%97 == 0 {
+			// longer than a table and an index cell
+			path += strings.Repeat("/long", 1000+i)
+		}
+		rows[i] = []interface{}{nil, name, "Function", path}
+		keys[i] = []interface{}{name, "Function", path, int64(i + 1)}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i][0].(string) < keys[j][0].(string) })
+
+	db := newSQLiteDB()
+	db.addTable("searchIndex", "CREATE TABLE searchIndex(id INTEGER PRIMARY KEY, name TEXT, type TEXT, path TEXT)", rows)
+	db.addIndex("anchor", "searchIndex", "CREATE UNIQUE INDEX anchor ON searchIndex (name, type, path)", keys)
+	var b bytes.Buffer
+	if _, err := db.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	data := b.Bytes()
+
+	if !bytes.HasPrefix(data, []byte("SQLite format 3\x00")) || len(data)%sqlitePageSize != 0 ||
+		int(binary.BigEndian.Uint32(data[28:])) != len(data)/sqlitePageSize {
+		t.Fatalf("invalid header or size %d", len(data))
+	}
+	f := &sqliteFile{t: t, data: data}
+	var schema [][]interface{}
+	f.walk(1, func(_ uint64, r []byte) { schema = append(schema, decodeSQLiteRecord(t, r)) })
+	if len(schema) != 2 || schema[0][1] != "searchIndex" || schema[1][1] != "anchor" {
+		t.Fatalf("schema = %v", schema)
+	}
+	tableRoot, indexRoot := uint32(schema[0][3].(int64)), uint32(schema[1][3].(int64))
+	if f.page(tableRoot)[0] != sqliteTableInterior || f.page(indexRoot)[0] != sqliteIndexInterior {
+		t.Errorf("the roots are not interior pages")
+	}
+
+	var gotRows [][]interface{}
+	f.walk(tableRoot, func(rowid uint64, r []byte) {
+		if rowid != uint64(len(gotRows)+1) {
+			t.Fatalf("rowid %d after %d rows", rowid, len(gotRows))
+		}
+		gotRows = append(gotRows, decodeSQLiteRecord(t, r))
+	})
+	if !reflect.DeepEqual(gotRows, rows) {
+		t.Errorf("read %d rows, want %d equal rows", len(gotRows), len(rows))
+	}
+	var gotKeys [][]interface{}
+	f.walk(indexRoot, func(_ uint64, r []byte) { gotKeys = append(gotKeys, decodeSQLiteRecord(t, r)) })
+	if !reflect.DeepEqual(gotKeys, keys) {
+		t.Errorf("read %d keys, want %d equal keys", len(gotKeys), len(keys))
+	}
+
+	sqlite, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	file := filepath.Join(t.TempDir(), "docSet.dsidx")
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(sqlite, file, "PRAGMA integrity_check; SELECT count(*) FROM searchIndex;").CombinedOutput()
+	if err != nil || strings.Fields(string(out))[0] != "ok" || strings.Fields(string(out))[1] != fmt.Sprint(n) {
+		t.Errorf("sqlite3: %v\n%s", err, out)
+	}
+}
+
+func TestSQLiteEmpty(t *testing.T) {
+	db := newSQLiteDB()
+	db.addTable("t", "CREATE TABLE t(a TEXT)", nil)
+	db.addIndex("i", "t", "CREATE INDEX i ON t (a)", nil)
+	var b bytes.Buffer
+	db.WriteTo(&b)
+	f := &sqliteFile{t: t, data: b.Bytes()}
+	for _, root := range []uint32{2, 3} {
+		f.walk(root, func(uint64, []byte) { t.Errorf("page %d is not empty", root) })
+	}
+}
@@ -94,6 +94,38 @@ func (t *TocItem) Add(label, href string) *TocItem {
 	return c
 }
 
+// Merge adds the children of another item recursively, keeping their order
+// and tags
+func (t *TocItem) Merge(o *TocItem) {
+	for _, oc := range o.children {
+		c := t.Add(oc.label, oc.href)
+		if oc.image > 0 {
+			c.image = oc.image
+		}
+		c.Merge(oc)
+	}
+}
+
+// Children returns the child items
+func (t *TocItem) Children() []*TocItem {
+	return t.children
+}
+
+// Remove removes the item from its parent
+func (t *TocItem) Remove() {
+	if t.parent == nil {
+		return
+	}
+	siblings := t.parent.children
+	for i, c := range siblings {
+		if c == t {
+			t.parent.children = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	t.parent = nil
+}
+
 // Parent returns parent
 func (t *TocItem) Parent() *TocItem {
 	return t.parent
@@ -132,6 +164,12 @@ func (t *TocItem) TagAs(tag string) {
 		t.image = 35
 	case "type", "class", "interface":
 		t.image = 37
+	case "unexported":
+		// the even images are the highlighted variants of the odd ones, the
+		// items without an image like the constants keep the default icon
+		if t.image%2 == 1 {
+			t.image++
+		}
 	default:
 		log.Fatal("Unknown tag: ", t)
 	}
@@ -0,0 +1,27 @@
+package chm
+
+import "testing"
+
+func TestTagAsUnexported(t *testing.T) {
+	tests := []struct {
+		tag   string
+		image int
+	}{
+		{"", 0}, // constants and variables keep the default icon
+		{"function", 18},
+		{"method", 20},
+		{"field", 36},
+		{"type", 38},
+		{"file", 12},
+	}
+	for _, tt := range tests {
+		item := NewToc().Root().Add("x", "x.html")
+		if tt.tag != "" {
+			item.TagAs(tt.tag)
+		}
+		item.TagAs("unexported")
+		if item.image != tt.image {
+			t.Errorf("unexported %q has the image %d, want %d", tt.tag, item.image, tt.image)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/char101/godoc-chm/chm"
+)
+
+// verifyCHM checks that a compiled file contains every file of the project
+// saved in a .hhp file with the same content, and the targets of the table of
+// contents and of the index. It returns the number of problems.
+func verifyCHM(hhp, file string) int {
+	pf := readProjectFile(hhp)
+	r, err := chm.OpenReader(file)
+	if err != nil {
+		log.Fatalf("%s: %v", file, err)
+	}
+	defer r.Close()
+
+	lc := newLinkChecker(pf)
+	lc.files = make(map[string]bool)
+	for _, f := range r.Files {
+		if !f.Internal() {
+			lc.files[strings.ToLower(strings.TrimPrefix(f.Name, "/"))] = true
+		}
+	}
+	lc.read = func(name string) ([]byte, error) {
+		return r.ReadFile("/" + name)
+	}
+
+	sys, err := r.System()
+	if err != nil {
+		log.Fatalf("%s: %v", file, err)
+	}
+	fmt.Printf("%s: %d files, title %q, default topic %s, %s\n", file, len(lc.files), sys.Title, sys.DefaultTopic, sys.CompilerVersion)
+	if !lc.files[strings.ToLower(sys.DefaultTopic)] {
+		lc.broken["#SYSTEM"] = append(lc.broken["#SYSTEM"], "default topic "+sys.DefaultTopic+" is missing")
+	}
+
+	for _, f := range pf.files {
+		if !lc.files[strings.ToLower(f)] {
+			lc.broken["[FILES]"] = append(lc.broken["[FILES]"], f+" is missing")
+			continue
+		}
+		data, err := lc.read(f)
+		if err != nil {
+			lc.broken["[FILES]"] = append(lc.broken["[FILES]"], fmt.Sprintf("%s: %v", f, err))
+			continue
+		}
+		if saved, err := os.ReadFile(filepath.Join(pf.dir, filepath.FromSlash(f))); err == nil && !bytes.Equal(data, saved) {
+			lc.broken["[FILES]"] = append(lc.broken["[FILES]"], f+" differs from the project file")
+		}
+	}
+	lc.checkSitemap(pf.contents)
+	lc.checkSitemap(pf.index)
+	return lc.report("problems")
+}
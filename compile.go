@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/char101/godoc-chm/chm"
+)
+
+var (
+	// the build fails on the compiler diagnostics of this severity or above,
+	// never if nil
+	failThreshold *chm.Severity
+	// file of the compiler result as JSON
+	diagnosticsFile string
+)
+
+// compileProject compiles the saved project and prints the result. It fails if
+// the compiler cannot run or reports a diagnostic at the threshold.
+func compileProject(c chm.Compiler) error {
+	res, err := c.Compile(project)
+	if res != nil {
+		fmt.Printf("Compiled %s with %s in %v: %d bytes, %d errors, %d warnings, %d notes\n",
+			res.File, res.Compiler, res.Duration.Round(time.Millisecond), res.Size,
+			res.Count(chm.SeverityError), res.Count(chm.SeverityWarning), res.Count(chm.SeverityNote))
+		for _, d := range res.Diagnostics {
+			fmt.Println("  " + d.String())
+		}
+		if diagnosticsFile != "" {
+			saveJSON(res, diagnosticsFile)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", c.Name(), err)
+	}
+	if failThreshold != nil && res.Failed(*failThreshold) {
+		return fmt.Errorf("compilation failed on diagnostics of severity %s or above", *failThreshold)
+	}
+	return nil
+}
+
+// saveJSON saves a value as indented JSON
+func saveJSON(v interface{}, file string) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
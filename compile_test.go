@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/char101/godoc-chm/chm"
+)
+
+func TestCompileProject(t *testing.T) {
+	defer func(p *chm.Project, threshold *chm.Severity, file string) {
+		project, failThreshold, diagnosticsFile = p, threshold, file
+	}(project, failThreshold, diagnosticsFile)
+	project = chm.NewProject("Go")
+
+	var (
+		note    = &chm.Diagnostic{Severity: chm.SeverityNote, Message: "the index is empty"}
+		warning = &chm.Diagnostic{Code: "HHC3004", Severity: chm.SeverityWarning, File: "Go.hhc", Message: "bad tag"}
+		failure = &chm.Diagnostic{Code: "HHC5010", Severity: chm.SeverityError, File: "a.html", Message: "Cannot open"}
+		sev     = func(s chm.Severity) *chm.Severity { return &s }
+	)
+	tests := []struct {
+		name        string
+		diagnostics []*chm.Diagnostic
+		err         error
+		threshold   *chm.Severity
+		fail        bool
+	}{
+		{"never", []*chm.Diagnostic{warning, failure}, nil, nil, false},
+		{"error", []*chm.Diagnostic{warning, failure}, nil, sev(chm.SeverityError), true},
+		{"warning below error", []*chm.Diagnostic{note, warning}, nil, sev(chm.SeverityError), false},
+		{"warning", []*chm.Diagnostic{note, warning}, nil, sev(chm.SeverityWarning), true},
+		{"note below warning", []*chm.Diagnostic{note}, nil, sev(chm.SeverityWarning), false},
+		{"note", []*chm.Diagnostic{note}, nil, sev(chm.SeverityNote), true},
+		{"no diagnostics", []*chm.Diagnostic{}, nil, sev(chm.SeverityNote), false},
+		{"compiler failed", []*chm.Diagnostic{}, errors.New("cannot run"), nil, true},
+	}
+	for _, tt := range tests {
+		res := &chm.CompileResult{Compiler: "stub", File: "Go.chm", Diagnostics: tt.diagnostics}
+		stub := &chm.StubCompiler{Result: res, Err: tt.err}
+		failThreshold = tt.threshold
+		diagnosticsFile = filepath.Join(t.TempDir(), "diagnostics.json")
+
+		if err := compileProject(stub); (err != nil) != tt.fail {
+			t.Errorf("%s: compileProject() = %v, want failure %v", tt.name, err, tt.fail)
+		}
+		if !reflect.DeepEqual(stub.Projects, []string{"Go"}) {
+			t.Errorf("%s: compiled %v", tt.name, stub.Projects)
+		}
+		data, err := os.ReadFile(diagnosticsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var saved chm.CompileResult
+		if err := json.Unmarshal(data, &saved); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(saved.Diagnostics, tt.diagnostics) {
+			t.Errorf("%s: saved %s", tt.name, data)
+		}
+	}
+}
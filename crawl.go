@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/char101/godoc-chm/chm"
+)
+
+var (
+	// number of packages downloaded and cleaned in parallel
+	workers = 1
+	// page layout of the server
+	layout Layout = godocLayout{}
+)
+
+// pkgJob is a package found in the package list, or a command or document
+type pkgJob struct {
+	title  string
+	link   string
+	url    string
+	pkg    string
+	kind   string // empty for packages, command or document
+	parent int    // index of the parent job, -1 for top level packages
+	toc    *chm.TocItem
+}
+
+// pkgResult contains the pages, toc and index of a single package
+type pkgResult struct {
+	fragment  *chm.Project
+	directory bool
+	title     string
+	hash      string  // content hash of the page in incremental builds
+	pages     []*page // pages of the files of the fragment
+	err       error
+}
+
+// processPackage downloads and cleans a package page and its source files into
+// a fragment project that is not shared with other workers
+func processPackage(job *pkgJob) *pkgResult {
+	entry, err := fetchEntry(job.url, true)
+	if err != nil {
+		return &pkgResult{err: err}
+	}
+
+	var hash string
+	if manifest != nil {
+		hash = contentHash(entry.Body)
+		if res := manifest.lookup(job.url, hash); res != nil {
+			log.Println("unchanged", job.pkg)
+			return res
+		}
+	}
+
+	index := findIndex
+	if job.kind != "" {
+		index = findHeadings
+	}
+	fragment := chm.NewProject(job.pkg)
+	pkgdoc, _, err := parseContent(fragment, job.url, entry, func(url string, doc *goquery.Document) {
+		index(fragment, url, doc, job.pkg)
+	})
+	if err != nil {
+		return &pkgResult{err: err}
+	}
+	return &pkgResult{
+		fragment:  fragment,
+		directory: job.kind != "document" && layout.IsDirectory(pkgdoc),
+		title:     getTitle(pkgdoc),
+		hash:      hash,
+		pages:     fragmentPages(fragment.GetFiles()),
+	}
+}
+
+// crawlPackages processes the packages using a pool of workers and merges the
+// results under the toc item in the package list order, so that the output
+// does not depend on the number of workers
+func crawlPackages(root *chm.TocItem, jobs []*pkgJob) {
+	for _, job := range jobs {
+		if job.kind != "document" {
+			job.url = pageURL(job.url)
+		}
+	}
+
+	results := make([]chan *pkgResult, len(jobs))
+	for i := range results {
+		results[i] = make(chan *pkgResult, 1)
+	}
+
+	queue := make(chan int)
+	go func() {
+		for i := range jobs {
+			queue <- i
+		}
+		close(queue)
+	}()
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range queue {
+				if res := checkpoint.get(jobs[i].url); res != nil {
+					results[i] <- res
+					continue
+				}
+				res := processPackage(jobs[i])
+				if res.err == nil {
+					checkpoint.add(jobs[i].url, res)
+				}
+				results[i] <- res
+			}
+		}()
+	}
+
+	var (
+		index = project.Index().Root()
+		dirs  = make([]bool, len(jobs))
+	)
+	for i, job := range jobs {
+		res := <-results[i]
+
+		parent := root
+		if job.parent >= 0 {
+			parent = jobs[job.parent].toc
+		}
+		if res.err != nil {
+			// keep the entry without a link so that subpackages are still nested
+			recordFailure(job.url, res.err)
+			job.toc = parent.Add(job.title, "")
+			continue
+		}
+		job.toc = parent.Add(job.title, job.link)
+
+		project.Merge(res.fragment, job.toc)
+		addPages(res.pages)
+		if manifest != nil {
+			manifest.add(job.url, res)
+		}
+
+		name := job.pkg[strings.LastIndex(job.pkg, "/")+1:]
+		switch {
+		case res.directory:
+			dirs[i] = true
+			job.toc.TagAs("directory")
+		case job.kind == "document":
+			// the index sorter requires keywords starting with a word
+			if funcNameRe.MatchString(job.title) {
+				indexTitle := fmt.Sprintf("%s%sdocument", job.title, chm.IndexSeparator)
+				index.Add(indexTitle).AddLocal(job.link, topic(res.title))
+			}
+		case job.kind == "command":
+			indexTitle := fmt.Sprintf("%s%scommand", name, chm.IndexSeparator)
+			index.Add(indexTitle).AddLocal(job.link, topic(res.title))
+		default:
+			indexTitle := fmt.Sprintf("%s%spackage %s", name, chm.IndexSeparator, job.pkg)
+			index.Add(indexTitle).AddLocal(job.link, topic(res.title))
+		}
+	}
+
+	// remove the directories whose subpackages have all been excluded,
+	// subdirectories first
+	for i := len(jobs) - 1; i >= 0; i-- {
+		if dirs[i] && len(jobs[i].toc.Children()) == 0 {
+			log.Println("removing empty directory", jobs[i].pkg)
+			jobs[i].toc.Remove()
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	urllib "net/url"
+	"regexp"
+	"strings"
+
+	"github.com/char101/godoc-chm/chm"
+	path "github.com/char101/path.go"
+)
+
+var (
+	cssURLRe    = regexp.MustCompile(`url\(\s*('[^']*'|"[^"]*"|[^'")]*?)\s*\)`)
+	cssImportRe = regexp.MustCompile(`@import\s+('[^']*'|"[^"]*")`)
+)
+
+// asset is a static file downloaded by the first page that references it
+type asset struct {
+	file string
+	done chan struct{} // closed once downloaded
+	ok   bool
+	refs []*asset // resources of a stylesheet
+}
+
+// downloadAsset downloads a static file once, the resources referenced by
+// stylesheets are downloaded too. The file is added to the projects by
+// addAssets.
+func downloadAsset(url string) *asset {
+	file := localFile(url)
+	staticMu.Lock()
+	a, ok := staticMap[file]
+	if !ok {
+		a = &asset{file: file, done: make(chan struct{})}
+		staticMap[file] = a
+	}
+	staticMu.Unlock()
+	// the asset is downloaded by another page, which never waits for other
+	// assets so that the workers cannot wait for each other
+	if ok {
+		return a
+	}
+	defer close(a.done)
+
+	entry, err := fetchEntry(url, true)
+	if err != nil {
+		recordFailure(url, err)
+		return a
+	}
+	data := entry.Body
+	if strings.HasSuffix(strings.ToLower(file), ".css") {
+		data, a.refs = rewriteCSS(url, data)
+	}
+	p := path.New(file)
+	p.Dir().MkdirAll()
+	p.Write(data)
+	addPage(&page{URL: url, Location: entry.Location, File: file})
+	a.ok = true
+	return a
+}
+
+// addAssets adds the files of the assets and of the resources of their
+// stylesheets to a project once they are downloaded. Every page adds the
+// assets it references in page order, so that the files of the project do not
+// depend on the worker that downloaded them.
+func addAssets(proj *chm.Project, assets []*asset) {
+	seen := make(map[*asset]bool)
+	var add func(a *asset)
+	add = func(a *asset) {
+		if seen[a] {
+			return
+		}
+		seen[a] = true
+		<-a.done
+		if a.ok {
+			proj.AddFile(a.file)
+		}
+		for _, r := range a.refs {
+			add(r)
+		}
+	}
+	for _, a := range assets {
+		add(a)
+	}
+}
+
+// rewriteCSS downloads the resources of the url() and @import references of a
+// stylesheet and rewrites them relative to the stylesheet
+func rewriteCSS(base string, css []byte) ([]byte, []*asset) {
+	var refs []*asset
+	rewrite := func(re *regexp.Regexp, format string) {
+		css = re.ReplaceAllFunc(css, func(m []byte) []byte {
+			ref := string(re.FindSubmatch(m)[1])
+			var quote string
+			if len(ref) >= 2 && (ref[0] == '\'' || ref[0] == '"') {
+				quote, ref = ref[:1], ref[1:len(ref)-1]
+			}
+			rel, a := cssRef(base, ref)
+			if a != nil {
+				refs = append(refs, a)
+			}
+			return []byte(fmt.Sprintf(format, quote+rel+quote))
+		})
+	}
+	rewrite(cssImportRe, "@import %s")
+	rewrite(cssURLRe, "url(%s)")
+	return css, refs
+}
+
+// cssRef downloads a resource referenced by a stylesheet and returns its path
+// relative to the stylesheet, references to other servers are kept
+func cssRef(base, ref string) (string, *asset) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "data:") || strings.HasPrefix(ref, "#") {
+		return ref, nil
+	}
+	abs := chm.AbsoluteURL(base, ref)
+	if !sameHost(base, abs) {
+		return ref, nil
+	}
+	a := downloadAsset(abs)
+
+	rel := relativeFile(localFile(base), localFile(abs))
+	// the query is not part of the file name, the fragment selects a font or
+	// an svg element
+	if u, err := urllib.Parse(abs); err == nil && u.Fragment != "" {
+		rel += "#" + u.Fragment
+	}
+	return rel, a
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/char101/godoc-chm/chm"
+)
+
+// sections of the godoc server crawled with -docs
+var docSections = []string{"cmd", "doc", "ref"}
+
+// default reference documents when the document list does not link any
+var defaultRefs = []*pageLink{
+	{label: "The Go Programming Language Specification", href: "/ref/spec"},
+	{label: "The Go Memory Model", href: "/ref/mem"},
+}
+
+// defined terms are short italic phrases
+var termRe = regexp.MustCompile(`^\w[\w -]*$`)
+
+// parseDocSections parses the comma separated sections of -docs
+func parseDocSections(list string) map[string]bool {
+	sections := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !contains(docSections, name) {
+			log.Fatalf("unknown section %s, supported sections: %s", name, strings.Join(docSections, ", "))
+		}
+		sections[name] = true
+	}
+	return sections
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// crawlDocs crawls the commands, documents and references of the godoc server
+// of the current source
+func crawlDocs(sections map[string]bool) {
+	if _, ok := layout.(godocLayout); !ok {
+		log.Printf("%s: -docs is only supported by the godoc layout", source.url)
+		return
+	}
+
+	if sections["cmd"] {
+		url := chm.AbsoluteURL(source.url, "/cmd/")
+		toc := source.toc.Add("Commands", localFile(url))
+		_, _, err := parse(project, url, true, func(url string, doc *goquery.Document) {
+			crawlPackages(toc, layout.(godocLayout).packageTree(url, doc, "command"))
+		})
+		if err != nil {
+			recordFailure(url, err)
+			toc.Remove()
+		}
+	}
+
+	if !sections["doc"] && !sections["ref"] {
+		return
+	}
+
+	var (
+		url        = chm.AbsoluteURL(source.url, "/doc/")
+		docs, refs []*pkgJob
+		process    = func(url string, doc *goquery.Document) {
+			docs, refs = documentLinks(url, doc)
+		}
+	)
+	if sections["doc"] {
+		toc := source.toc.Add("Documents", localFile(url))
+		if _, _, err := parse(project, url, true, process); err != nil {
+			recordFailure(url, err)
+			toc.Remove()
+		} else {
+			crawlPackages(toc, docs)
+		}
+	} else if content, err := fetch(url, true); err != nil {
+		recordFailure(url, err)
+	} else if doc, err := goquery.NewDocumentFromReader(strings.NewReader(string(content))); err == nil {
+		process(url, doc)
+	}
+
+	if sections["ref"] {
+		if len(refs) == 0 {
+			for _, l := range defaultRefs {
+				refs = append(refs, documentJob(url, l.href, l.label))
+			}
+		}
+		crawlPackages(source.toc.Add("References", ""), refs)
+	}
+}
+
+// documentLinks returns the documents and the references on the same server
+// linked from the document list
+func documentLinks(url string, doc *goquery.Document) (docs, refs []*pkgJob) {
+	seen := map[string]bool{url: true}
+	doc.Find("#page a[href]").Each(func(i int, a *goquery.Selection) {
+		href, _ := a.Attr("href")
+		if href == "" || strings.HasPrefix(href, "#") || !sameHost(url, chm.AbsoluteURL(url, href)) {
+			return
+		}
+		job := documentJob(url, href, chm.CleanTitle(a.Text()))
+		if seen[job.url] {
+			return
+		}
+		seen[job.url] = true
+		switch {
+		case strings.HasPrefix(job.pkg, "doc/"):
+			docs = append(docs, job)
+		case strings.HasPrefix(job.pkg, "ref/"):
+			refs = append(refs, job)
+		}
+	})
+	return
+}
+
+// documentJob returns the job of a document, the fragment of the link is
+// removed
+func documentJob(base, href, label string) *pkgJob {
+	u := chm.AbsoluteURL(base, href)
+	if i := strings.Index(u, "#"); i >= 0 {
+		u = u[:i]
+	}
+	p := chm.GetFilename(u)
+	if label == "" {
+		label = p
+	}
+	return &pkgJob{
+		title:  label,
+		link:   localFile(u),
+		url:    u,
+		pkg:    p,
+		kind:   "document",
+		parent: -1,
+	}
+}
+
+// findHeadings fills the toc of a command or document fragment from the h2 and
+// h3 headings, and its index from the productions and the defined terms of the
+// references
+func findHeadings(proj *chm.Project, url string, doc *goquery.Document, name string) {
+	log.Println("findHeadings:", url)
+
+	var (
+		toc   = proj.Toc().Root()
+		index = proj.Index().Root()
+		title = topic(getTitle(doc))
+		page  = doc.Find("#page")
+		h2    *chm.TocItem
+	)
+	if page.Length() == 0 {
+		page = doc.Find("body")
+	}
+
+	page.Find("h2[id], h3[id]").Each(func(i int, s *goquery.Selection) {
+		id, _ := s.Attr("id")
+		label := chm.CleanTitle(s.Text())
+		if label == "" {
+			return
+		}
+		link := localLink(url, "#"+id)
+		if goquery.NodeName(s) == "h3" && h2 != nil {
+			h2.Add(label, link)
+			return
+		}
+		t := toc.Add(label, link)
+		if goquery.NodeName(s) == "h2" {
+			h2 = t
+		}
+	})
+
+	// productions are linked by godoc in the ebnf blocks of the specification
+	page.Find("pre.ebnf a[id]").Each(func(i int, s *goquery.Selection) {
+		id, _ := s.Attr("id")
+		if funcNameRe.MatchString(id) {
+			index.Add(fmt.Sprintf("%s%sproduction in %s", id, chm.IndexSeparator, name)).AddLocal(localLink(url, "#"+id), title)
+		}
+	})
+
+	if !strings.HasPrefix(name, "ref/") {
+		return
+	}
+	// terms are defined in italic and linked to the heading of their section
+	page.Find("p i").Each(func(i int, s *goquery.Selection) {
+		term := chm.CleanTitle(s.Text())
+		if !termRe.MatchString(term) || strings.Count(term, " ") > 3 {
+			return
+		}
+		link := localFile(url)
+		if h := s.Closest("p").PrevAllFiltered("h2[id], h3[id], h4[id]").First(); h.Length() > 0 {
+			id, _ := h.Attr("id")
+			link = localLink(url, "#"+id)
+		}
+		index.Add(fmt.Sprintf("%s%sterm in %s", term, chm.IndexSeparator, name)).AddLocal(link, title)
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	httpClient = &http.Client{Timeout: time.Minute}
+	retries    = 3
+	retryDelay = time.Second
+	cacheTTL   = 24 * time.Hour
+	offline    = false
+	failures   = make(map[string]error)
+	failuresMu sync.Mutex
+)
+
+// StatusError is returned when the server responds with a non 200 status
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// ErrNotCached is returned in offline mode for pages missing from the cache
+var ErrNotCached = errors.New("not in cache")
+
+// temporary returns true if the request might succeed when retried
+func (e *StatusError) temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// fetch URL as string, retrying network errors and server errors. Cached
+// entries older than the cache ttl are revalidated with the server. In offline
+// mode every page is read from the cache.
+func fetch(url string, useCache bool) ([]byte, error) {
+	e, err := fetchEntry(url, useCache)
+	if err != nil {
+		return nil, err
+	}
+	return e.Body, nil
+}
+
+// fetchEntry is fetch returning the entry, which also has the URL of the page
+// after redirects
+func fetchEntry(url string, useCache bool) (*cacheEntry, error) {
+	if offline {
+		if e := cache.get(url); e != nil {
+			return e, nil
+		}
+		return nil, ErrNotCached
+	}
+
+	var cached *cacheEntry
+	if useCache && cache != nil {
+		cached = cache.get(url)
+		if cached != nil && cached.fresh(cacheTTL) {
+			return cached, nil
+		}
+	}
+
+	var (
+		entry *cacheEntry
+		err   error
+		delay = retryDelay
+	)
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			log.Printf("retrying %s in %v (%v)", url, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+		entry, err = download(url, cached)
+		if err == nil {
+			break
+		}
+		if se, ok := err.(*StatusError); ok && !se.temporary() {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cache != nil {
+		cache.set(url, entry)
+	}
+	return entry, nil
+}
+
+// download requests the URL once, using the validators of the cached entry
+// to make a conditional request
+func download(url string, cached *cacheEntry) (*cacheEntry, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	log.Println("downloading", url)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		log.Println("not modified", url)
+		return &cacheEntry{
+			Body:         cached.Body,
+			ETag:         cached.ETag,
+			LastModified: cached.LastModified,
+			Location:     cached.Location,
+			Fetched:      time.Now(),
+		}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{url, resp.StatusCode}
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", url, err)
+	}
+	var location string
+	if u := resp.Request.URL.String(); u != url {
+		location = u
+	}
+	return &cacheEntry{
+		Body:         body,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Location:     location,
+		Fetched:      time.Now(),
+	}, nil
+}
+
+// recordFailure records a page that could not be downloaded so that the crawl
+// can continue without it
+func recordFailure(url string, err error) {
+	log.Println("skipping", url+":", err)
+	failuresMu.Lock()
+	failures[url] = err
+	failuresMu.Unlock()
+}
+
+// reportFailures prints the pages skipped during the crawl
+func reportFailures() {
+	if len(failures) == 0 {
+		return
+	}
+	urls := make([]string, 0, len(failures))
+	for url := range failures {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	fmt.Printf("%d pages failed:\n", len(urls))
+	for _, url := range urls {
+		fmt.Printf("  %s: %v\n", url, failures[url])
+	}
+}
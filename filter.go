@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// packages that are crawled, all packages if empty
+	includes []*regexp.Regexp
+	// packages that are not crawled
+	excludes []*regexp.Regexp
+)
+
+// preset is a named pattern selected with -preset
+type preset struct {
+	include bool
+	pattern string
+}
+
+var presets = map[string]preset{
+	"no-internal": {false, `re:(^|/)internal(/|$)`},
+	"no-vendor":   {false, `re:(^|/)vendor(/|$)`},
+	"no-testdata": {false, `re:(^|/)testdata(/|$)`},
+	"std-only":    {true, `re:^[^./]+(/|$)`},
+	"x-only":      {true, `golang.org/x/...`},
+}
+
+// compilePattern compiles a package pattern. Patterns starting with "re:" are
+// regular expressions matched against the package path, other patterns are
+// globs matching the whole path where * does not match a slash, ** matches
+// anything and a trailing /... also matches the subpackages.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(pattern, "re:") {
+		return regexp.Compile(pattern[3:])
+	}
+
+	var (
+		b    strings.Builder
+		glob = pattern
+		sub  = strings.HasSuffix(glob, "/...")
+	)
+	if sub {
+		glob = strings.TrimSuffix(glob, "/...")
+	}
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case strings.HasPrefix(glob[i:], "..."):
+			b.WriteString(".*")
+			i += 2
+		case glob[i] == '*':
+			b.WriteString("[^/]*")
+		case glob[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	if sub {
+		b.WriteString("(/.*)?")
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// patternFlag is a repeatable flag adding patterns to a list
+type patternFlag struct {
+	patterns *[]*regexp.Regexp
+}
+
+func (f patternFlag) String() string {
+	if f.patterns == nil {
+		return ""
+	}
+	s := make([]string, len(*f.patterns))
+	for i, re := range *f.patterns {
+		s[i] = re.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+func (f patternFlag) Set(pattern string) error {
+	re, err := compilePattern(pattern)
+	if err != nil {
+		return err
+	}
+	*f.patterns = append(*f.patterns, re)
+	return nil
+}
+
+// presetFlag is a repeatable flag adding presets, separated by comma
+type presetFlag struct{}
+
+func (presetFlag) String() string { return "" }
+
+func (presetFlag) Set(names string) error {
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		p, ok := presets[name]
+		if !ok {
+			return fmt.Errorf("unknown preset %s, supported presets: %s", name, presetNames())
+		}
+		list := &excludes
+		if p.include {
+			list = &includes
+		}
+		if err := (patternFlag{list}).Set(p.pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func presetNames() string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// addBlacklist excludes the packages starting with the prefixes separated by
+// comma
+func addBlacklist(blacklist string) {
+	for _, bl := range strings.Split(blacklist, ",") {
+		bl = strings.Trim(strings.TrimSpace(bl), "/")
+		if bl != "" {
+			excludes = append(excludes, regexp.MustCompile("^"+regexp.QuoteMeta(bl)+"(/|$)"))
+		}
+	}
+}
+
+// isExcluded returns true if the package does not match any include pattern or
+// matches an exclude pattern
+func isExcluded(pkg string) bool {
+	for _, re := range excludes {
+		if re.MatchString(pkg) {
+			return true
+		}
+	}
+	if len(includes) == 0 {
+		return false
+	}
+	for _, re := range includes {
+		if re.MatchString(pkg) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/char101/godoc-chm/chm"
+	"golang.org/x/net/html"
+)
+
+var (
+	styleRe      = regexp.MustCompile(`padding-left:\s*(\d+)px`)
+	nbspPrefixRe = regexp.MustCompile("^(\\s*(\u00A0|&nbsp;))*")
+	nbspRe       = regexp.MustCompile("(\u00A0|&nbsp;)")
+
+	// crawl the package pages with the unexported declarations
+	allSymbols bool
+)
+
+// godocLayout reads the pages of the classic godoc server
+type godocLayout struct{}
+
+func (godocLayout) Name() string { return "godoc" }
+
+func (godocLayout) Detect(doc *goquery.Document) bool {
+	return doc.Find("div#topbar, td.pkg-name, #manual-nav").Length() > 0
+}
+
+func (godocLayout) RootURL(url string) string {
+	if strings.HasSuffix(url, "/pkg") {
+		return url + "/"
+	} else if !strings.HasSuffix(url, "/pkg/") {
+		return strings.TrimSuffix(url, "/") + "/pkg/"
+	}
+	return url
+}
+
+func (godocLayout) Remove() []string {
+	return []string{"div#menu"}
+}
+
+// Packages reads the package tree from the padding of the td.pkg-name cells
+func (l godocLayout) Packages(url string, doc *goquery.Document) []*pkgJob {
+	return l.packageTree(url, doc, "")
+}
+
+// packageTree reads the package list, or the command list which has the same
+// layout, as jobs of the given kind. The package filters do not apply to the
+// commands.
+func (godocLayout) packageTree(url string, doc *goquery.Document, kind string) []*pkgJob {
+	var (
+		prevLevel = 0
+		prevTitle string
+		parents   = make([]string, 0, 5)
+		indexes   = make(map[string]int)
+		jobs      = make([]*pkgJob, 0, 200)
+		getLevel  = func(s *goquery.Selection) int {
+			style, ok := s.Attr("style")
+			if !ok {
+				log.Fatal("style attribute not found")
+			}
+			matches := styleRe.FindStringSubmatch(style)
+			if matches != nil {
+				padding, err := strconv.Atoi(matches[1])
+				if err != nil {
+					log.Fatal(err)
+				}
+				return padding / 20
+			}
+			log.Fatal("cannot find padding")
+			return 0
+		}
+	)
+
+	doc.Find("td.pkg-name").Each(func(i int, s *goquery.Selection) {
+		level := getLevel(s)
+		if level > prevLevel {
+			parents = append(parents, prevTitle)
+		} else if level < prevLevel {
+			parents = parents[:len(parents)-(prevLevel-level)]
+		}
+
+		a := s.Find("a")
+		href, _ := a.Attr("href")
+
+		title := chm.CleanTitle(a.Text())
+		fullPkg := strings.TrimPrefix(strings.Join(parents, "/")+"/"+title, "/")
+
+		prevLevel = level
+		prevTitle = title
+
+		if kind != "command" && isExcluded(fullPkg) {
+			log.Println(fullPkg, "is excluded")
+			return
+		}
+
+		// packages whose parent is excluded are nested under the closest
+		// crawled ancestor
+		parent, label := nearestParent(indexes, fullPkg)
+		if parent < 0 {
+			label = fullPkg
+		}
+		indexes[fullPkg] = len(jobs)
+		jobs = append(jobs, &pkgJob{
+			title:  label,
+			link:   localLink(url, href),
+			url:    chm.AbsoluteURL(url, href),
+			pkg:    fullPkg,
+			kind:   kind,
+			parent: parent,
+		})
+	})
+
+	return jobs
+}
+
+func (godocLayout) IsDirectory(doc *goquery.Document) bool {
+	h1 := doc.Find("#page h1")
+	return strings.HasPrefix(strings.TrimSpace(h1.Text()), "Directory /")
+}
+
+// Declarations reads the #manual-nav list where the functions and methods of
+// a type are indented with &nbsp;
+func (godocLayout) Declarations(url string, doc *goquery.Document) []*declaration {
+	var (
+		decls    = make([]*declaration, 0)
+		typeName string
+		getLevel = func(s *goquery.Selection) int {
+			var (
+				text    = s.Text()
+				prefix  = nbspPrefixRe.FindString(text)
+				matches = nbspRe.FindAllStringIndex(prefix, -1)
+			)
+			return len(matches) / 2
+		}
+		// values adds the spans with an id following a section header
+		values = func(kind, id string) {
+			curr := doc.Find("#" + id).Next()
+			for curr.Length() > 0 && goquery.NodeName(curr) != "h2" {
+				curr.Find("span").Each(func(i int, s *goquery.Selection) {
+					if id, ok := s.Attr("id"); ok {
+						decls = append(decls, &declaration{kind: kind, label: chm.CleanTitle(s.Text()), name: declName(id), link: localLink(url, "#"+id)})
+					}
+				})
+				curr = curr.Next()
+			}
+		}
+	)
+
+	doc.Find("#manual-nav dd").Each(func(i int, s *goquery.Selection) {
+		if getLevel(s) == 0 {
+			typeName = ""
+		}
+
+		a := s.Find("a")
+		href, ok := a.Attr("href")
+		if !ok {
+			log.Fatal("href not found")
+		}
+
+		text := chm.CleanTitle(a.Text())
+		link := localLink(url, href)
+		switch {
+		case strings.HasPrefix(text, "type "):
+			typeName = text[5:]
+			decls = append(decls, &declaration{kind: "type", label: typeName, name: typeName, link: link})
+
+			// struct fields are the text following the spans in the declaration
+			var id string
+			doc.Find("h2#" + typeName).Next().Contents().Each(func(i int, s *goquery.Selection) {
+				if id != "" && s.Get(0).Type == html.TextNode {
+					decls = append(decls, &declaration{kind: "field", label: chm.CleanTitle(s.Text()), typeName: typeName, name: declName(id), link: localLink(url, "#"+id)})
+					id = ""
+				} else if goquery.NodeName(s) == "span" {
+					id, _ = s.Attr("id")
+				}
+			})
+		case strings.HasPrefix(text, "func ("):
+			text = strings.TrimSpace(funcReceiverRe.ReplaceAllString(text[5:], ""))
+			decls = append(decls, &declaration{kind: "method", label: text, typeName: typeName, name: declName(href), link: link})
+		case strings.HasPrefix(text, "func "):
+			decls = append(decls, &declaration{kind: "func", label: text[5:], typeName: typeName, name: declName(href), link: link})
+		default:
+			decls = append(decls, &declaration{kind: "section", label: text, link: link})
+			if text == "Constants" {
+				values("const", "pkg-constants")
+			} else if text == "Variables" {
+				values("var", "pkg-variables")
+			}
+		}
+	})
+
+	return decls
+}
+
+// h3Links returns the links in the element following a h3 header
+func h3Links(url string, doc *goquery.Document, header string, absolute bool) []*pageLink {
+	links := make([]*pageLink, 0)
+	doc.Find("h3").Each(func(i int, h3 *goquery.Selection) {
+		if h3.Text() != header {
+			return
+		}
+		h3.Next().Find("a").Each(func(i int, a *goquery.Selection) {
+			href, _ := a.Attr("href")
+			if absolute {
+				href = chm.AbsoluteURL(url, href)
+			} else {
+				href = localLink(url, href)
+			}
+			links = append(links, &pageLink{label: a.Text(), href: href})
+		})
+	})
+	return links
+}
+
+func (godocLayout) Examples(url string, doc *goquery.Document) []*pageLink {
+	return h3Links(url, doc, "Examples", false)
+}
+
+func (godocLayout) SourceFiles(url string, doc *goquery.Document) []*pageLink {
+	return h3Links(url, doc, "Package files", true)
+}
+
+// OnlinePath maps the package and command pages, /pkg/fmt/ is /fmt online
+func (godocLayout) OnlinePath(p string) string {
+	switch {
+	case strings.HasPrefix(p, "/pkg/") && len(p) > len("/pkg/"):
+		return strings.TrimSuffix(strings.TrimPrefix(p, "/pkg"), "/")
+	case strings.HasPrefix(p, "/cmd/") && len(p) > len("/cmd/"):
+		return strings.TrimSuffix(p, "/")
+	}
+	return ""
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"go/token"
+	"log"
+	urllib "net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/char101/godoc-chm/chm"
+)
+
+// Layout reads the package list and the package documentation out of the
+// pages of one kind of documentation server. Supporting a new server or a new
+// version of its markup means adding a Layout to the layouts list.
+type Layout interface {
+	// Name returns the name used to select the layout with the -layout flag
+	Name() string
+
+	// Detect returns true if the page fetched from the URL given on the
+	// command line uses this layout
+	Detect(doc *goquery.Document) bool
+
+	// RootURL returns the URL of the package list from the URL given on the
+	// command line
+	RootURL(url string) string
+
+	// Remove returns the selectors of the elements removed from saved pages
+	Remove() []string
+
+	// Packages lists the packages linked from the package list page
+	Packages(url string, doc *goquery.Document) []*pkgJob
+
+	// IsDirectory returns true if a package page only lists subdirectories
+	IsDirectory(doc *goquery.Document) bool
+
+	// Declarations lists the sections and declarations of a package page in
+	// page order, with the declarations of a type following the type
+	Declarations(url string, doc *goquery.Document) []*declaration
+
+	// Examples lists the examples of a package page
+	Examples(url string, doc *goquery.Document) []*pageLink
+
+	// SourceFiles lists the source files of a package page, the links are
+	// absolute URLs
+	SourceFiles(url string, doc *goquery.Document) []*pageLink
+
+	// OnlinePath returns the path of a page of the server in the online
+	// documentation like pkg.go.dev, or an empty string if it has none
+	OnlinePath(path string) string
+}
+
+// declaration is an entry listed by Layout.Declarations
+type declaration struct {
+	kind     string // section, const, var, func, type, method or field
+	label    string // toc label, the signature without "func " for functions
+	typeName string // type of a method or field, or of a function returning the type
+	name     string // declared identifier, from the anchor of the declaration
+	link     string // local link
+}
+
+// declName returns the identifier declared at an anchor, Type.Name for the
+// methods and fields
+func declName(anchor string) string {
+	anchor = anchor[strings.LastIndex(anchor, "#")+1:]
+	return anchor[strings.LastIndex(anchor, ".")+1:]
+}
+
+// pageLink is a labelled link of a package page
+type pageLink struct {
+	label string
+	href  string
+}
+
+// layouts lists the supported layouts, tried in order when detecting
+var layouts = []Layout{
+	godocLayout{},
+	pkgsiteLayout{},
+}
+
+// findLayout returns the layout with the given name
+func findLayout(name string) Layout {
+	for _, l := range layouts {
+		if l.Name() == name {
+			return l
+		}
+	}
+	names := make([]string, len(layouts))
+	for i, l := range layouts {
+		names[i] = l.Name()
+	}
+	log.Fatalf("unknown layout %s, supported layouts: auto, %s", name, strings.Join(names, ", "))
+	return nil
+}
+
+// detectLayout fetches the URL given on the command line and returns the first
+// layout that recognizes the page, the error is the one of the download
+func detectLayout(url string) (Layout, error) {
+	content, err := fetch(url, false)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(string(content)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, l := range layouts {
+		if l.Detect(doc) {
+			log.Println("detected layout", l.Name())
+			return l, nil
+		}
+	}
+	log.Fatalf("cannot detect the layout of %s, use -layout", url)
+	return nil, nil
+}
+
+// localLink returns the link of an URL of the current source relative to the
+// output directory
+func localLink(base, href string) string {
+	link := chm.AbsolutePath(base, href)
+	// the query of the base URL, like ?m=all, is kept for fragments
+	if u, err := urllib.Parse(link); err == nil && u.RawQuery != "" {
+		u.RawQuery = ""
+		link = u.String()
+	}
+	return source.prefix + strings.TrimPrefix(link, "/")
+}
+
+// nearestParent returns the index of the closest ancestor of a package in
+// indexes and the path of the package relative to it, or -1 if no ancestor is
+// crawled
+func nearestParent(indexes map[string]int, pkg string) (int, string) {
+	for p := pkg; strings.Contains(p, "/"); {
+		p = p[:strings.LastIndex(p, "/")]
+		if i, ok := indexes[p]; ok {
+			return i, strings.TrimPrefix(pkg, p+"/")
+		}
+	}
+	return -1, ""
+}
+
+// findPackages crawls the packages found in the package list page
+func findPackages(url string, doc *goquery.Document) {
+	log.Println("findPackages", url)
+	crawlPackages(source.toc, layout.Packages(url, doc))
+}
+
+// findIndex fills the toc and index of a package fragment project and
+// downloads the source files of the package
+func findIndex(proj *chm.Project, url string, doc *goquery.Document, pkg string) {
+	log.Println(strings.Repeat("  ", strings.Count(pkg, "/")+1)+"findIndex:", url)
+
+	if layout.IsDirectory(doc) {
+		return
+	}
+
+	var (
+		toc     = proj.Toc().Root()
+		index   = proj.Index().Root()
+		title   = topic(pkg)
+		types   = make(map[string]*chm.TocItem)
+		fields  = make(map[string]*chm.TocItem)
+		typeToc = func(name string) *chm.TocItem {
+			if t, ok := types[name]; ok {
+				return t
+			}
+			return toc
+		}
+		groups = map[string]string{"const": "Constants", "var": "Variables"}
+		ids    = map[string]string{"const": "#pkg-constants", "var": "#pkg-variables"}
+	)
+
+	for _, d := range layout.Declarations(url, doc) {
+		// unexported declarations are listed with -all-symbols
+		var unexported string
+		if d.kind != "section" && d.name != "" && !token.IsExported(d.name) {
+			unexported = "unexported "
+		}
+
+		var item *chm.TocItem
+		switch d.kind {
+		case "section":
+			toc.Add(d.label, d.link)
+		case "const", "var":
+			if d.typeName == "" {
+				item = toc.Add(groups[d.kind], localLink(url, ids[d.kind])).Add(d.label, d.link)
+			}
+			index.Add(fmt.Sprintf("%s%s%s%s in %s", d.label, chm.IndexSeparator, unexported, d.kind, pkg)).AddLocal(d.link, title)
+		case "type":
+			item = toc.Add(d.label, d.link)
+			item.TagAs("type")
+			types[d.label] = item
+			index.Add(fmt.Sprintf("%s%s%stype in %s", d.label, chm.IndexSeparator, unexported, pkg)).AddLocal(d.link, title)
+		case "func":
+			item = typeToc(d.typeName).Add(d.label, d.link)
+			item.TagAs("function")
+			index.Add(fmt.Sprintf("%s%s%sfunc in %s", simplifyFunc(d.label), chm.IndexSeparator, unexported, pkg)).AddLocal(d.link, title)
+		case "method":
+			item = typeToc(d.typeName).Add(d.label, d.link)
+			item.TagAs("method")
+			if !strings.HasPrefix(d.label, "String() string") {
+				index.Add(fmt.Sprintf("%s%s%smethod of %s in %s", simplifyFunc(d.label), chm.IndexSeparator, unexported, d.typeName, pkg)).AddLocal(d.link, title)
+			}
+		case "field":
+			ft, ok := fields[d.typeName]
+			if !ok {
+				ft = typeToc(d.typeName).Add("Fields", "")
+				fields[d.typeName] = ft
+			}
+			item = ft.Add(d.label, d.link)
+			item.TagAs("field")
+		default:
+			log.Fatalf("unknown declaration kind: %s", d.kind)
+		}
+		if item != nil && unexported != "" {
+			item.TagAs("unexported")
+		}
+	}
+
+	if examples := layout.Examples(url, doc); len(examples) > 0 {
+		t := toc.Add("Examples", "")
+		for _, ex := range examples {
+			t.Add(ex.label, ex.href)
+		}
+	}
+
+	if files := layout.SourceFiles(url, doc); len(files) > 0 {
+		t := toc.Add("Files", "")
+		for _, f := range files {
+			if !sameHost(url, f.href) {
+				// source hosted elsewhere is linked instead of downloaded
+				t.Add(f.label, f.href).TagAs("file")
+				continue
+			}
+			var sf *sourceFile
+			if _, _, err := parse(proj, f.href, true, func(u string, sdoc *goquery.Document) {
+				sf = formatSource(f.label, sdoc)
+			}); err != nil {
+				recordFailure(f.href, err)
+				continue
+			}
+			ft := t.Add(f.label, localLink(url, f.href))
+			ft.TagAs("file")
+			for _, d := range sf.decls {
+				item := ft.Add(d.label, localLink(url, f.href+"#"+d.anchor()))
+				if d.kind != "" {
+					item.TagAs(d.kind)
+				}
+				if !token.IsExported(d.name) {
+					item.TagAs("unexported")
+				}
+			}
+			selectDeclarations(url, doc, f.href, sf)
+		}
+	}
+}
+
+// selectDeclarations rewrites the links of a package page selecting the lines
+// of a declaration in a source file with ?s=start:end to the anchor of the
+// declaration, the query is not part of the file name of the source page
+func selectDeclarations(url string, doc *goquery.Document, file string, sf *sourceFile) {
+	fu, err := urllib.Parse(file)
+	if err != nil {
+		return
+	}
+	doc.Find("a[href]").Each(func(i int, a *goquery.Selection) {
+		href, _ := a.Attr("href")
+		u, err := urllib.Parse(chm.AbsoluteURL(url, href))
+		if err != nil || u.Host != fu.Host || u.Path != fu.Path || (u.RawQuery == "" && u.Fragment == "") {
+			return
+		}
+		line := selectionLine(sf, u.Query().Get("s"), u.Fragment)
+		if line == 0 {
+			return
+		}
+		u.RawQuery = ""
+		u.Fragment = sf.anchorAt(line)
+		a.SetAttr("href", u.String())
+	})
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	urllib "net/url"
+	"os"
+	pathlib "path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// projectFile contains the parts of a .hhp file needed to check the output
+type projectFile struct {
+	dir      string
+	files    []string
+	contents string
+	index    string
+}
+
+// readProjectFile reads the files and the toc and index file names of a .hhp
+// file, the paths use slashes and are relative to the directory of the project
+func readProjectFile(hhp string) *projectFile {
+	f, err := os.Open(hhp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	pf := &projectFile{dir: filepath.Dir(hhp)}
+	var section string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = line
+		case section == "[OPTIONS]":
+			k, v, _ := strings.Cut(line, "=")
+			switch strings.ToLower(k) {
+			case "contents file":
+				pf.contents = strings.Replace(v, `\`, "/", -1)
+			case "index file":
+				pf.index = strings.Replace(v, `\`, "/", -1)
+			}
+		case section == "[FILES]":
+			pf.files = append(pf.files, strings.Replace(line, `\`, "/", -1))
+		}
+	}
+	if err := s.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return pf
+}
+
+// sitemapLocals returns the Local parameters of the content of a .hhc or .hhk
+// file
+func sitemapLocals(data []byte) []string {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+	if err != nil {
+		log.Fatal(err)
+	}
+	locals := make([]string, 0)
+	doc.Find("param").Each(func(i int, s *goquery.Selection) {
+		if name, _ := s.Attr("name"); strings.EqualFold(name, "Local") {
+			v, _ := s.Attr("value")
+			locals = append(locals, v)
+		}
+	})
+	return locals
+}
+
+// linkChecker checks that the local links of the pages, the toc and the index
+// resolve to a project file and to an element id of that file. File names are
+// compared ignoring case like the CHM viewer.
+type linkChecker struct {
+	files  map[string]bool
+	ids    map[string]map[string]bool
+	broken map[string][]string
+	// read returns the content of a file, from the project directory or
+	// from the compiled file
+	read func(file string) ([]byte, error)
+}
+
+func newLinkChecker(pf *projectFile) *linkChecker {
+	lc := &linkChecker{
+		files:  make(map[string]bool),
+		ids:    make(map[string]map[string]bool),
+		broken: make(map[string][]string),
+		read: func(file string) ([]byte, error) {
+			return os.ReadFile(filepath.Join(pf.dir, filepath.FromSlash(file)))
+		},
+	}
+	for _, f := range pf.files {
+		lc.files[strings.ToLower(f)] = true
+	}
+	return lc
+}
+
+// isHTML returns true if the content of a file is a HTML page
+func isHTML(file string, data []byte) bool {
+	switch strings.ToLower(pathlib.Ext(file)) {
+	case ".html", ".htm":
+		return true
+	case ".css", ".js", ".png", ".gif", ".jpg", ".jpeg", ".svg", ".ico", ".woff", ".woff2", ".ttf", ".eot":
+		return false
+	}
+	head := data
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	return bytes.Contains(bytes.ToLower(head), []byte("<html"))
+}
+
+// load parses a project file, returning nil if it is not a page
+func (lc *linkChecker) load(file string) *goquery.Document {
+	data, err := lc.read(file)
+	if err != nil || !isHTML(file, data) {
+		return nil
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	return doc
+}
+
+// elementIDs returns the ids and anchor names of a page
+func (lc *linkChecker) elementIDs(file string) map[string]bool {
+	key := strings.ToLower(file)
+	if ids, ok := lc.ids[key]; ok {
+		return ids
+	}
+	var ids map[string]bool
+	if doc := lc.load(file); doc != nil {
+		ids = documentIDs(doc)
+	}
+	lc.ids[key] = ids
+	return ids
+}
+
+// documentIDs returns the ids and anchor names of a document
+func documentIDs(doc *goquery.Document) map[string]bool {
+	ids := make(map[string]bool)
+	doc.Find("[id], a[name]").Each(func(i int, s *goquery.Selection) {
+		if id, ok := s.Attr("id"); ok {
+			ids[id] = true
+		}
+		if name, ok := s.Attr("name"); ok && goquery.NodeName(s) == "a" {
+			ids[name] = true
+		}
+	})
+	return ids
+}
+
+// check resolves a link found in page, base is the file the link is relative
+// to, an empty base means the project directory
+func (lc *linkChecker) check(page, base, href string) {
+	href = strings.TrimSpace(href)
+	if href == "" || strings.HasPrefix(href, "//") || strings.HasPrefix(href, "data:") {
+		return
+	}
+	u, err := urllib.Parse(href)
+	if err != nil {
+		lc.broken[page] = append(lc.broken[page], fmt.Sprintf("%s: %v", href, err))
+		return
+	}
+	if u.Scheme != "" || u.Host != "" {
+		return
+	}
+
+	target := base
+	if u.Path != "" {
+		target = pathlib.Join(pathlib.Dir(base), u.Path)
+		if strings.HasSuffix(u.Path, "/") {
+			target += "/index.html"
+		}
+	}
+	if !lc.files[strings.ToLower(target)] {
+		lc.broken[page] = append(lc.broken[page], fmt.Sprintf("%s: %s is not a project file", href, target))
+		return
+	}
+	if u.Fragment == "" {
+		return
+	}
+	if ids := lc.elementIDs(target); ids != nil && !ids[u.Fragment] {
+		lc.broken[page] = append(lc.broken[page], fmt.Sprintf("%s: no element %s in %s", href, u.Fragment, target))
+	}
+}
+
+// checkPage checks the links of a page
+func (lc *linkChecker) checkPage(file string) {
+	doc := lc.load(file)
+	if doc == nil {
+		return
+	}
+	for _, attr := range []struct{ selector, name string }{
+		{"a[href]", "href"},
+		{"link[href]", "href"},
+		{"script[src]", "src"},
+		{"img[src]", "src"},
+	} {
+		doc.Find(attr.selector).Each(func(i int, s *goquery.Selection) {
+			v, _ := s.Attr(attr.name)
+			if strings.HasPrefix(strings.ToLower(v), "javascript:") || strings.HasPrefix(strings.ToLower(v), "mailto:") {
+				return
+			}
+			lc.check(file, file, v)
+		})
+	}
+}
+
+// checkSitemap checks the Local parameters of a .hhc or .hhk file
+func (lc *linkChecker) checkSitemap(file string) {
+	if file == "" {
+		return
+	}
+	data, err := lc.read(file)
+	if err != nil {
+		lc.broken[file] = append(lc.broken[file], err.Error())
+		return
+	}
+	for _, local := range sitemapLocals(data) {
+		// the locals are relative to the project directory
+		lc.check(file, "", local)
+	}
+}
+
+// report prints the problems, like broken links, grouped by page and returns
+// their number
+func (lc *linkChecker) report(what string) int {
+	pages := make([]string, 0, len(lc.broken))
+	for page := range lc.broken {
+		pages = append(pages, page)
+	}
+	sort.Strings(pages)
+
+	n := 0
+	for _, page := range pages {
+		links := lc.broken[page]
+		sort.Strings(links)
+		fmt.Printf("%s: %d %s\n", page, len(links), what)
+		for _, l := range links {
+			fmt.Println("  " + l)
+		}
+		n += len(links)
+	}
+	if n == 0 {
+		fmt.Println("No " + what)
+	} else {
+		fmt.Printf("%d %s in %d files\n", n, what, len(pages))
+	}
+	return n
+}
+
+// verifyLinks checks the links of the project saved in a .hhp file and
+// returns the number of broken links
+func verifyLinks(hhp string) int {
+	pf := readProjectFile(hhp)
+	lc := newLinkChecker(pf)
+	for _, f := range pf.files {
+		lc.checkPage(f)
+	}
+	lc.checkSitemap(pf.contents)
+	lc.checkSitemap(pf.index)
+	return lc.report("broken links")
+}
+
+// verifyCommand implements the verify subcommand
+func verifyCommand(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	var chmFile string
+	fs.StringVar(&chmFile, "chm", "", "Check the compiled file instead of the links")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s verify [-chm file.chm] [project.hhp]\nChecks the links of the pages, the table of contents and the index.\nWith -chm checks that the compiled file contains the files of the project and the targets of the table of contents and the index.\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	hhp := "Go.hhp"
+	if fs.NArg() > 0 {
+		hhp = fs.Arg(0)
+	}
+	if chmFile != "" {
+		if verifyCHM(hhp, chmFile) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if verifyLinks(hhp) > 0 {
+		os.Exit(1)
+	}
+}
@@ -3,61 +3,31 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
-	urllib "net/url"
 	"os"
 	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/char101/godoc-chm/chm"
 	path "github.com/char101/path.go"
-	"golang.org/x/net/html"
 )
 
 type processFunc func(string, *goquery.Document)
 
 var (
-	styleRe             = regexp.MustCompile(`padding-left:\s*(\d+)px`)
-	nbspPrefixRe        = regexp.MustCompile("^(\\s*(\u00A0|&nbsp;))*")
-	nbspRe              = regexp.MustCompile("(\u00A0|&nbsp;)")
-	absoluteURLRe       = regexp.MustCompile(`^(http|https|ftp)?://`)
-	funcReceiverRe      = regexp.MustCompile(`^\(.+?\)`)
-	project             = chm.NewProject("Go")
-	cache               *Cache
-	staticMap           = make(map[string]bool)
-	blacklistedPrefixes = make([]string, 0)
-	funcNameRe          = regexp.MustCompile(`^\w+`)
+	absoluteURLRe  = regexp.MustCompile(`^(http|https|ftp)?://`)
+	funcReceiverRe = regexp.MustCompile(`^\(.+?\)`)
+	project        = chm.NewProject("Go")
+	cache          *Cache
+	staticMap      = make(map[string]*asset)
+	staticMu       sync.Mutex
+	funcNameRe     = regexp.MustCompile(`^\w+`)
 )
 
-// fetch URL as string
-func fetch(url string, useCache bool) []byte {
-	if useCache && cache != nil {
-		data := cache.get(url)
-		if data != nil {
-			return data
-		}
-	}
-	log.Println("downloading", url)
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatal(err)
-	}
-	if cache != nil {
-		cache.set(url, body)
-	}
-	return body
-}
-
 func save(data interface{}, file string) {
 	p := path.New(file)
 	p.Dir().MkdirAll()
@@ -76,397 +46,220 @@ func save(data interface{}, file string) {
 	}
 }
 
-func clean(url string, doc *goquery.Document) {
-	fixPath := func(tag string, attr string) {
-		doc.Find(tag).Each(func(i int, s *goquery.Selection) {
-			val, _ := s.Attr(attr)
-			if val != "" {
-				if !(strings.HasPrefix(val, "//") ||
-					strings.HasPrefix(val, "http://") ||
-					strings.HasPrefix(val, "https://")) {
-					val = chm.RelativePath(url, val)
-
-					p, err := urllib.Parse(chm.AbsolutePath(url, val))
-					if err != nil {
-						log.Fatal(err)
-					}
-					if path.New(p.Path[1:]).IsDir() {
-						if !strings.HasSuffix(val, "/") {
-							val += "/"
-						}
-						val = chm.AddIndex(val)
-					}
-					s.SetAttr(attr, val)
-				}
-			}
-		})
-	}
-
-	removeElements := func(selector string) {
-		doc.Find(selector).Remove()
+func parse(proj *chm.Project, url string, cache bool, process processFunc) (*goquery.Document, string, error) {
+	entry, err := fetchEntry(url, cache)
+	if err != nil {
+		return nil, "", err
 	}
-
-	removeElements("div#menu")
-
-	doc.Find("a").Each(func(i int, s *goquery.Selection) {
-		href, _ := s.Attr("href")
-		if href != "" {
-			if href == "/" {
-				s.SetAttr("href", "#")
-			} else {
-				// remove GET parameters to source file link because it results in a page not found error page
-				p, err := urllib.Parse(href)
-				if err != nil {
-					log.Fatal(err)
-				}
-				if p.RawQuery != "" {
-					p.RawQuery = ""
-					s.SetAttr("href", p.String())
-				}
-			}
-		}
-	})
-
-	doc.Find("head").AppendHtml(`<link rel="stylesheet" href="/custom.css">`)
-
-	fixPath("a", "href")
-	fixPath("link[rel='stylesheet']", "href")
-	fixPath("script", "src")
-	fixPath("img", "src")
+	return parseContent(proj, url, entry, process)
 }
 
-func parse(url string, cache bool, process processFunc) (*goquery.Document, string) {
-	var (
-		file    = chm.GetFilename(url)
-		content = fetch(url, cache)
-		reader  = strings.NewReader(string(content))
-	)
-
-	doc, err := goquery.NewDocumentFromReader(reader)
+// parseContent processes and saves a page that has already been fetched, its
+// links are rewritten by the render phase
+func parseContent(proj *chm.Project, url string, entry *cacheEntry, process processFunc) (*goquery.Document, string, error) {
+	file := localFile(url)
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(string(entry.Body)))
 	if err != nil {
-		log.Fatal(err)
+		return nil, "", fmt.Errorf("%s: %v", url, err)
 	}
 
-	// process first then clean to keep the original URL
 	if process != nil {
 		process(url, doc)
 	}
-	downloadStatic(url, doc)
-
-	clean(url, doc)
+	p := &page{URL: url, Location: entry.Location, File: file, HTML: true}
+	if manifest != nil {
+		p.Hash = contentHash(entry.Body)
+	}
+	downloadStatic(proj, p.base(), doc)
 
 	save(doc, file)
 
-	project.AddFile(file)
+	proj.AddFile(file)
+
+	p.ids = documentIDs(doc)
+	addPage(p)
 
-	return doc, file
+	return doc, file, nil
 }
 
-func downloadStatic(baseURL string, doc *goquery.Document) {
+func downloadStatic(proj *chm.Project, baseURL string, doc *goquery.Document) {
+	var assets []*asset
 	process := func(selector string, attr string) {
 		doc.Find(selector).Each(func(i int, s *goquery.Selection) {
 			url, _ := s.Attr(attr)
 			if url != "" {
-				url = chm.AbsoluteURL(baseURL, url)
-				_, ok := staticMap[url]
-				if !ok {
-					file := chm.GetFilename(url)
-					p := path.New(file)
-					p.Dir().MkdirAll()
-					p.Write(fetch(url, true))
-				}
-				staticMap[url] = true
+				assets = append(assets, downloadAsset(chm.AbsoluteURL(baseURL, url)))
 			}
 		})
 	}
 	process("link[rel='stylesheet']", "href")
 	process("script", "src")
 	process("img", "src")
+
+	doc.Find("style").Each(func(i int, s *goquery.Selection) {
+		css, refs := rewriteCSS(baseURL, []byte(s.Text()))
+		s.SetText(string(css))
+		assets = append(assets, refs...)
+	})
+	doc.Find("[style]").Each(func(i int, s *goquery.Selection) {
+		style, _ := s.Attr("style")
+		css, refs := rewriteCSS(baseURL, []byte(style))
+		s.SetAttr("style", string(css))
+		assets = append(assets, refs...)
+	})
+	addAssets(proj, assets)
 }
 
 func getTitle(doc *goquery.Document) string {
 	return chm.CleanTitle(doc.Find("title").Text())
 }
 
-func isBlacklisted(pkg string) bool {
-	for _, bl := range blacklistedPrefixes {
-		if bl == pkg || strings.HasPrefix(pkg, bl+"/") {
-			return true
-		}
-	}
-	return false
-}
-
 // removes parameters and return values from function prototype
 func simplifyFunc(f string) string {
 	return fmt.Sprintf("%s()", funcNameRe.FindString(f))
 }
 
-func findIndex(toc *chm.TocItem, url string, doc *goquery.Document, pkg string) {
-	var (
-		prevLevel = 0
-		currToc   = toc
-		prevToc   *chm.TocItem
-		index     = project.Index().Root()
-		//index     = proj.Index().Root()
-		getLevel = func(s *goquery.Selection) int {
-			var (
-				text    = s.Text()
-				prefix  = nbspPrefixRe.FindString(text)
-				matches = nbspRe.FindAllStringIndex(prefix, -1)
-			)
-			return len(matches) / 2
-		}
-	)
-	log.Println(strings.Repeat("  ", toc.Level())+"findIndex:", url)
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	h1 := doc.Find("#page h1")
-	if strings.HasPrefix(strings.TrimSpace(h1.Text()), "Directory /") {
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		cacheCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		verifyCommand(os.Args[2:])
 		return
 	}
 
-	doc.Find("#manual-nav dd").Each(func(i int, s *goquery.Selection) {
-		level := getLevel(s)
-		if level > prevLevel {
-			currToc = prevToc
-		} else if level < prevLevel {
-			for i = level; i < prevLevel; i++ {
-				currToc = currToc.Parent()
-			}
-		}
+	var useCache bool
+	flag.BoolVar(&useCache, "cache", false, "Cache request responses in a database")
 
-		a := s.Find("a")
-		href, ok := a.Attr("href")
-		if !ok {
-			log.Fatal("href not found")
-		}
+	flag.BoolVar(&offline, "offline", false, "Build from the cache only without connecting to the server")
 
-		text := chm.CleanTitle(a.Text())
-		link := strings.TrimPrefix(chm.AbsolutePath(url, href), "/")
-		tag := ""
-		if strings.HasPrefix(text, "type ") {
-			tag = "type"
-			text = text[5:]
-			index.Add(fmt.Sprintf("%s%stype in %s", text, chm.IndexSeparator, pkg)).AddLocal(link, pkg)
-		} else if strings.HasPrefix(text, "func ") {
-			text = text[5:]
-			if strings.HasPrefix(text, "(") {
-				tag = "method"
-				text = strings.TrimSpace(funcReceiverRe.ReplaceAllString(text, ""))
-				if !strings.HasPrefix(text, "String() string") {
-					index.Add(fmt.Sprintf("%s%smethod of %s in %s", simplifyFunc(text), chm.IndexSeparator, currToc.Label(), pkg)).AddLocal(link, pkg)
-				}
-			} else {
-				tag = "function"
-				index.Add(fmt.Sprintf("%s%sfunc in %s", simplifyFunc(text), chm.IndexSeparator, pkg)).AddLocal(link, pkg)
-			}
-		}
+	flag.DurationVar(&cacheTTL, "cache-ttl", cacheTTL, "Age after which cached responses are revalidated, 0 to always revalidate")
 
-		t := currToc.Add(text, link)
-		if tag != "" {
-			t.TagAs(tag)
-		}
+	var outputDir string
+	flag.StringVar(&outputDir, "output", "", "Output directory for downloaded files")
 
-		// add struct fields to the toc
-		if tag == "type" {
-			var id string
-			var ft *chm.TocItem // fields toc, created as necessary
-			doc.Find("h2#" + text).Next().Contents().Each(func(i int, s *goquery.Selection) {
-				if id != "" && s.Get(0).Type == html.TextNode {
-					if ft == nil {
-						ft = t.Add("Fields", "")
-					}
-					tf := ft.Add(chm.CleanTitle(s.Text()), strings.TrimPrefix(chm.AbsolutePath(url, "#"+id), "/"))
-					tf.TagAs("field")
-					id = ""
-				} else if goquery.NodeName(s) == "span" {
-					id, _ = s.Attr("id")
-				}
-			})
-		}
+	var blacklist string
+	flag.StringVar(&blacklist, "blacklist", "", "Blacklisted prefixes, separated by comma")
 
-		if text == "Constants" {
-			constants := doc.Find("#pkg-constants")
-			curr := constants.Next()
-			for curr.Length() > 0 && goquery.NodeName(curr) != "h2" {
-				curr.Find("span").Each(func(i int, s *goquery.Selection) {
-					if id, ok := s.Attr("id"); ok {
-						text := chm.CleanTitle(s.Text())
-						link := strings.TrimPrefix(chm.AbsolutePath(url, "#"+id), "/")
-						t.Add(text, link)
-						index.Add(fmt.Sprintf("%s%sconst in %s", text, chm.IndexSeparator, pkg)).AddLocal(link, pkg)
-					}
-				})
-				curr = curr.Next()
-			}
-		} else if text == "Variables" {
-			variables := doc.Find("#pkg-variables")
-			curr := variables.Next()
-			for curr.Length() > 0 && goquery.NodeName(curr) != "h2" {
-				curr.Find("span").Each(func(i int, s *goquery.Selection) {
-					if id, ok := s.Attr("id"); ok {
-						text := chm.CleanTitle(s.Text())
-						link := strings.TrimPrefix(chm.AbsolutePath(url, "#"+id), "/")
-						t.Add(text, link)
-						index.Add(fmt.Sprintf("%s%svar in %s", text, chm.IndexSeparator, pkg)).AddLocal(link, pkg)
-					}
-				})
-				curr = curr.Next()
-			}
-		}
+	flag.Var(patternFlag{&includes}, "include", "Only crawl the packages matching a glob, or a regular expression prefixed with re:, can be repeated")
 
-		prevLevel = level
-		prevToc = t
-	})
+	flag.Var(patternFlag{&excludes}, "exclude", "Do not crawl the packages matching a glob, or a regular expression prefixed with re:, can be repeated")
 
-	doc.Find("h3").Each(func(i int, h3 *goquery.Selection) {
-		if h3.Text() == "Examples" {
-			t := toc.Add("Examples", "")
-			h3.Next().Find("a").Each(func(i int, a *goquery.Selection) {
-				text := a.Text()
-				href, _ := a.Attr("href")
-				t.Add(text, strings.TrimPrefix(chm.AbsolutePath(url, href), "/"))
-			})
-		}
-		if h3.Text() == "Package files" {
-			t := toc.Add("Files", "")
-			h3.Next().Find("a").Each(func(i int, a *goquery.Selection) {
-				text := a.Text()
-				href, _ := a.Attr("href")
-				t.Add(text, strings.TrimPrefix(chm.AbsolutePath(url, href), "/"))
-
-				// to download and clean the page
-				parse(chm.AbsoluteURL(url, href), true, nil)
-			})
-		}
-	})
-}
+	flag.Var(presetFlag{}, "preset", "Filter presets separated by comma: "+presetNames())
 
-func findPackages(url string, doc *goquery.Document) {
-	var (
-		prevLevel       = 0
-		toc             = project.Toc().Root()
-		prevToc         *chm.TocItem
-		prevTitle       string
-		prevBlacklisted bool
-		index           = project.Index().Root()
-		getLevel        = func(s *goquery.Selection) int {
-			style, ok := s.Attr("style")
-			if !ok {
-				log.Fatal("style attribute not found")
-			}
-			matches := styleRe.FindStringSubmatch(style)
-			if matches != nil {
-				padding, err := strconv.Atoi(matches[1])
-				if err != nil {
-					log.Fatal(err)
-				}
-				return padding / 20
-			}
-			log.Fatal("cannot find padding")
-			return 0
-		}
-		isDirectory = func(doc *goquery.Document) bool {
-			h1 := doc.Find("#page h1")
-			return strings.HasPrefix(strings.TrimSpace(h1.Text()), "Directory /")
-		}
-	)
+	flag.StringVar(&outsidePolicy, "outside-links", outsidePolicy, "Links to pages outside the crawl: server, online (on -online-base), external (online and marked) or text")
 
-	log.Println("findPackages", url)
+	flag.StringVar(&onlineBase, "online-base", onlineBase, "Base URL of the online documentation for -outside-links online and external")
 
-	parents := make([]string, 0, 5)
+	var compile bool
+	flag.BoolVar(&compile, "compile", false, "Compile project into chm")
 
-	doc.Find("td.pkg-name").Each(func(i int, s *goquery.Selection) {
-		level := getLevel(s)
-		if level > prevLevel {
-			if !prevBlacklisted {
-				toc = prevToc
-			}
-			parents = append(parents, prevTitle)
-		} else if level < prevLevel {
-			for i = level; i < prevLevel; i++ {
-				if !prevBlacklisted {
-					toc = toc.Parent()
-				}
-				parents = parents[:len(parents)-1]
-			}
-		}
+	var compilerName string
+	flag.StringVar(&compilerName, "compiler", "auto", "Compiler of -compile: auto (hhw if installed, else native), hhw, chmcmd, native or stub")
 
-		a := s.Find("a")
-		href, _ := a.Attr("href")
+	var compilerPath string
+	flag.StringVar(&compilerPath, "compiler-path", "", "Installation directory of HTML Help Workshop for hhw, executable for chmcmd")
 
-		title := chm.CleanTitle(a.Text())
-		link := strings.TrimPrefix(chm.AbsolutePath(url, href), "/")
+	var failOn string
+	flag.StringVar(&failOn, "fail-on", "error", "Fail the build on compiler diagnostics of this severity or above: note, warning, error or never")
 
-		fullPkg := strings.TrimPrefix(strings.Join(parents, "/")+"/"+title, "/")
-		blacklisted := isBlacklisted(fullPkg)
-		if blacklisted {
-			log.Println(fullPkg, "is blacklisted")
-		} else {
-			tc := toc.Add(title, link)
+	flag.StringVar(&diagnosticsFile, "diagnostics", "", "Save the compiler result with its diagnostics as JSON in this file")
 
-			au := chm.AbsoluteURL(url, href)
+	var open bool
+	flag.BoolVar(&open, "open", false, "Open the project in HTML Help Workshop")
 
-			pkgdoc, _ := parse(au, true, func(url string, doc *goquery.Document) {
-				findIndex(tc, url, doc, fullPkg)
-			})
+	var verify bool
+	flag.BoolVar(&verify, "verify", false, "Check the links of the pages, the table of contents and the index after the build, and the compiled file with -compile")
 
-			if isDirectory(pkgdoc) {
-				tc.TagAs("directory")
-			} else {
-				indexTitle := fmt.Sprintf("%s%spackage %s", title, chm.IndexSeparator, fullPkg)
-				index.Add(indexTitle).AddLocal(link, getTitle(pkgdoc))
-			}
+	var docset bool
+	flag.BoolVar(&docset, "docset", false, "Also save the project as a Dash/Zeal docset in the output directory")
 
-			prevToc = tc
-		}
+	var chmPath string
+	flag.StringVar(&chmPath, "chm", "", "Path for the output chm")
 
-		prevLevel = level
-		prevTitle = title
-		prevBlacklisted = blacklisted
-	})
-}
+	flag.IntVar(&workers, "workers", 1, "Number of packages downloaded in parallel")
 
-func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	flag.DurationVar(&httpClient.Timeout, "timeout", time.Minute, "Timeout of a single request")
 
-	var useCache bool
-	flag.BoolVar(&useCache, "cache", false, "Cache request responses in a database")
+	flag.IntVar(&retries, "retries", 3, "Number of retries of a failed request")
 
-	var outputDir string
-	flag.StringVar(&outputDir, "output", "", "Output directory for downloaded files")
+	flag.DurationVar(&retryDelay, "retry-delay", time.Second, "Delay before the first retry, doubled on each retry")
 
-	var blacklist string
-	flag.StringVar(&blacklist, "blacklist", "", "Blacklisted prefixes, separated by comma")
+	var layoutName string
+	flag.StringVar(&layoutName, "layout", "auto", "Page layout of the server: auto, godoc or pkgsite")
 
-	var compile bool
-	flag.BoolVar(&compile, "compile", false, "Compile project into chm")
+	var docs string
+	flag.StringVar(&docs, "docs", "", "Also crawl sections of the godoc server separated by comma: cmd, doc, ref")
 
-	var open bool
-	flag.BoolVar(&open, "open", false, "Open the project in HTML Help Workshop")
+	flag.BoolVar(&allSymbols, "all-symbols", false, "Include the unexported declarations of the packages, godoc layout only")
 
-	var chmPath string
-	flag.StringVar(&chmPath, "chm", "", "Path for the output chm")
+	var platforms string
+	flag.StringVar(&platforms, "platforms", "", "Build the package pages for GOOS or GOOS/GOARCH platforms separated by comma, each in its own branch when there are several")
+
+	var resume bool
+	flag.BoolVar(&resume, "resume", false, "Continue an interrupted build from the checkpoint in the output directory")
+
+	var incremental bool
+	flag.BoolVar(&incremental, "incremental", false, "Only process the packages whose page changed since the previous build in the output directory")
+
+	var sourceDir string
+	flag.StringVar(&sourceDir, "source", "", "Build from the packages in a GOROOT/src or module directory instead of a godoc server")
 
 	flag.Parse()
 
-	if flag.NArg() == 0 {
-		fmt.Fprintf(os.Stderr, "Usage: %s [flags] godoc-url\nFlags:\n", os.Args[0])
+	if flag.NArg() == 0 && sourceDir == "" {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [label=]url...\n       %s [flags] -source directory\n       %s cache command\n       %s verify [-chm file.chm] [project.hhp]\nThe urls are godoc servers or pkgsite modules, several urls are merged into one project.\nFlags:\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	if blacklist != "" {
-		for _, bl := range strings.Split(blacklist, "/") {
-			blacklistedPrefixes = append(blacklistedPrefixes, strings.TrimSpace(bl))
+	if workers < 1 {
+		log.Fatalf("invalid number of workers: %d", workers)
+	}
+
+	if !contains(outsidePolicies, outsidePolicy) {
+		log.Fatalf("unknown policy %s, supported policies: %s", outsidePolicy, strings.Join(outsidePolicies, ", "))
+	}
+
+	if compilerPath != "" && strings.ContainsAny(compilerPath, `/\`) {
+		// resolve before changing to the output directory
+		p, err := filepath.Abs(compilerPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		compilerPath = p
+	}
+	compiler, err := chm.NewCompiler(compilerName, compilerPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if failOn != "never" {
+		threshold, err := chm.ParseSeverity(failOn)
+		if err != nil {
+			log.Fatalf("-fail-on: %v or never", err)
 		}
+		failThreshold = &threshold
+	}
+	if diagnosticsFile != "" {
+		if diagnosticsFile, err = filepath.Abs(diagnosticsFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if blacklist != "" {
+		addBlacklist(blacklist)
 	}
 
-	godocURL := flag.Arg(0)
-	if strings.HasSuffix(godocURL, "/pkg") {
-		godocURL += "/"
-	} else if !strings.HasSuffix(godocURL, "/pkg/") {
-		godocURL += "/pkg/"
+	if sourceDir != "" {
+		// resolve before changing to the output directory
+		dir, err := filepath.Abs(sourceDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sourceDir = dir
 	}
 
 	if outputDir != "" {
@@ -477,8 +270,8 @@ func main() {
 		path.New(outputDir).MkdirAll().Chdir()
 	}
 
-	if useCache {
-		cache = newCache()
+	if useCache || offline {
+		cache = newCache("cache.db")
 		defer cache.close()
 	}
 
@@ -486,9 +279,67 @@ func main() {
 		project.SetCompiledFile(chmPath)
 	}
 
-	project.Toc().Root().Add("Packages", "pkg/index.html")
-	project.SetStartFile("pkg/index.html")
-	parse(godocURL, false, findPackages)
+	if sourceDir != "" {
+		project.Toc().Root().Add("Packages", "pkg/index.html")
+		project.SetStartFile("pkg/index.html")
+		buildFromSource(sourceDir)
+	} else {
+		sections := parseDocSections(docs)
+		var platformList []string
+		if platforms != "" {
+			platformList = strings.Split(platforms, ",")
+		}
+		sources = parseSources(flag.Args(), platformList)
+		checkpoint = openCheckpoint(strings.Join(append(flag.Args(), platformList...), " "), resume)
+		if incremental {
+			manifest = loadManifest()
+		}
+		// offline, a source whose root page is not in the cache is skipped so
+		// that every missing page is listed
+		skipSource := func(url string, err error) {
+			if !offline {
+				log.Fatalf("%s: %v", url, err)
+			}
+			recordFailure(url, err)
+		}
+		for i, src := range sources {
+			source = src
+			if layoutName == "auto" {
+				l, err := detectLayout(src.url)
+				if err != nil {
+					skipSource(src.url, err)
+					continue
+				}
+				layout = l
+			} else {
+				layout = findLayout(layoutName)
+			}
+			if allSymbols && layout.Name() != "godoc" {
+				log.Printf("%s: -all-symbols is only supported by the godoc layout", src.url)
+			}
+			src.url = layout.RootURL(src.url)
+			src.layout = layout
+			startFile := localFile(src.url)
+			if i == 0 {
+				project.SetStartFile(startFile)
+			}
+			// a single source keeps its packages at the top level
+			if len(sources) == 1 {
+				project.Toc().Root().Add("Packages", startFile)
+				src.toc = project.Toc().Root()
+			} else {
+				src.toc = project.Toc().Root().Add(src.label, startFile)
+			}
+			if _, _, err := parse(project, src.url, false, findPackages); err != nil {
+				skipSource(src.url, err)
+				continue
+			}
+			if len(sections) > 0 {
+				crawlDocs(sections)
+			}
+		}
+		renderPages()
+	}
 	if outputDir != "" {
 		exe, err := os.Executable()
 		if err != nil {
@@ -496,12 +347,48 @@ func main() {
 		}
 		chm.LinkFile(path.New(exe).Dir().Join("custom.css").String(), outputDir)
 	}
+	if offline && len(failures) > 0 {
+		reportFailures()
+		log.Fatal("offline build failed, the pages above are not in the cache")
+	}
 	project.AddFile("custom.css")
 	project.Save()
+	if manifest != nil {
+		manifest.save()
+	}
+	if checkpoint != nil {
+		checkpoint.remove()
+	}
+	reportFailures()
+	reportOutsideLinks()
+	// the build fails after the other steps if the verification finds problems
+	problems := 0
+	if verify {
+		problems += verifyLinks(project.Name() + ".hhp")
+	}
+	if docset {
+		if err := project.SaveDocset(project.Name() + ".docset"); err != nil {
+			log.Fatal(err)
+		}
+	}
 	if open {
-		project.MustOpen()
+		hhw := &chm.HHW{}
+		if compilerName == "hhw" {
+			hhw.Dir = compilerPath
+		}
+		if err := hhw.Open(project); err != nil {
+			log.Fatal(err)
+		}
 	}
 	if compile {
-		project.MustCompile()
+		if err := compileProject(compiler); err != nil {
+			log.Fatal(err)
+		}
+		if verify {
+			problems += verifyCHM(project.Name()+".hhp", project.GetCompiledFile())
+		}
+	}
+	if problems > 0 {
+		log.Fatalf("verification failed with %d problems", problems)
 	}
 }
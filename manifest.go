@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/char101/godoc-chm/chm"
+	path "github.com/char101/path.go"
+)
+
+const manifestFile = "manifest.json"
+
+// manifestEntry is a package of the previous build
+type manifestEntry struct {
+	Hash      string       `json:"hash"`
+	Directory bool         `json:"directory,omitempty"`
+	Title     string       `json:"title,omitempty"`
+	Fragment  *chm.Project `json:"fragment"`
+	Pages     []*page      `json:"pages"`
+}
+
+// Manifest keeps the content hash of every package page together with its
+// toc and index so that unchanged packages are not processed again. It is safe
+// for concurrent use.
+type Manifest struct {
+	mu      sync.Mutex
+	old     map[string]*manifestEntry
+	entries map[string]*manifestEntry
+}
+
+// manifest of the incremental build, nil when building everything
+var manifest *Manifest
+
+// loadManifest reads the manifest of the previous build in the output directory
+func loadManifest() *Manifest {
+	m := &Manifest{
+		old:     make(map[string]*manifestEntry),
+		entries: make(map[string]*manifestEntry),
+	}
+	data, err := os.ReadFile(manifestFile)
+	if os.IsNotExist(err) {
+		return m
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &m.old); err != nil {
+		log.Printf("ignoring invalid manifest: %v", err)
+	}
+	return m
+}
+
+// contentHash returns the hash of a page stored in the manifest
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// lookup returns the result of the previous build if the page and the source
+// files have the same content and all the files of the package are still in
+// the output directory
+func (m *Manifest) lookup(url, hash string) *pkgResult {
+	m.mu.Lock()
+	e, ok := m.old[url]
+	m.mu.Unlock()
+	// manifests written before the render phase have no pages
+	if !ok || e.Hash != hash || e.Fragment == nil || len(e.Pages) == 0 {
+		return nil
+	}
+	for _, f := range e.Fragment.GetFiles() {
+		// project files use the windows separator
+		if !path.New(filepath.FromSlash(strings.Replace(f, "\\", "/", -1))).Exists() {
+			return nil
+		}
+	}
+	// the source files are revalidated separately, the package page is
+	// unchanged when only the body of a function has changed
+	for _, p := range e.Pages {
+		if !p.HTML || p.URL == url {
+			continue
+		}
+		// manifests written before the source hashes
+		if p.Hash == "" {
+			return nil
+		}
+		entry, err := fetchEntry(p.URL, true)
+		if err != nil || contentHash(entry.Body) != p.Hash {
+			return nil
+		}
+	}
+	return &pkgResult{fragment: e.Fragment, directory: e.Directory, title: e.Title, hash: hash, pages: e.Pages}
+}
+
+// add records a package of the current build
+func (m *Manifest) add(url string, res *pkgResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[url] = &manifestEntry{Hash: res.hash, Directory: res.directory, Title: res.title, Fragment: res.fragment, Pages: res.pages}
+}
+
+// save writes the packages of the current build, packages that have been
+// removed or have failed are dropped
+func (m *Manifest) save() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, err := json.Marshal(m.entries)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(manifestFile, data, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"log"
+	urllib "net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/char101/godoc-chm/chm"
+)
+
+// pkgsiteLayout reads the pages of a pkgsite (pkg.go.dev) server, starting
+// from the page of the standard library or of a module
+type pkgsiteLayout struct{}
+
+var versionRe = regexp.MustCompile(`@[^/]*`)
+
+// pkgsitePath returns the package path of a pkgsite link without the version
+func pkgsitePath(base, href string) string {
+	p := strings.Trim(chm.AbsolutePath(base, href), "/")
+	p = strings.TrimSuffix(p, "index.html")
+	if i := strings.IndexAny(p, "#?"); i >= 0 {
+		p = p[:i]
+	}
+	return strings.Trim(versionRe.ReplaceAllString(p, ""), "/")
+}
+
+func (pkgsiteLayout) Name() string { return "pkgsite" }
+
+func (pkgsiteLayout) Detect(doc *goquery.Document) bool {
+	return doc.Find("header.go-Header, .UnitDirectories-table, .Documentation").Length() > 0
+}
+
+// RootURL adds a trailing slash so that the page is saved as an index.html
+func (pkgsiteLayout) RootURL(url string) string {
+	if !strings.HasSuffix(url, "/") {
+		url += "/"
+	}
+	return url
+}
+
+// Remove returns the elements of the pkgsite layout that are not useful offline
+func (pkgsiteLayout) Remove() []string {
+	return []string{
+		"header.go-Header",
+		"footer.go-Footer",
+		"aside.go-Banner",
+		".UnitHeader-breadcrumbs",
+		".js-searchForm",
+		"script",
+	}
+}
+
+// Packages reads the directories section, nesting each package under the
+// nearest parent that has a page
+func (pkgsiteLayout) Packages(url string, doc *goquery.Document) []*pkgJob {
+	var (
+		root  = pkgsitePath(url, url)
+		urls  = make(map[string]string)
+		paths = make([]string, 0)
+	)
+	doc.Find("#section-directories a, .UnitDirectories-table a").Each(func(i int, a *goquery.Selection) {
+		href, _ := a.Attr("href")
+		if href == "" || strings.HasPrefix(href, "#") || absoluteURLRe.MatchString(href) {
+			return
+		}
+		pkg := pkgsitePath(url, href)
+		if _, ok := urls[pkg]; ok || pkg == root {
+			return
+		}
+		urls[pkg] = chm.AbsoluteURL(url, href)
+		paths = append(paths, pkg)
+	})
+	sort.Slice(paths, func(i, j int) bool {
+		return comparePath(paths[i], paths[j]) < 0
+	})
+
+	jobs := make([]*pkgJob, 0, len(paths))
+	indexes := make(map[string]int)
+	for _, pkg := range paths {
+		if isExcluded(pkg) {
+			log.Println(pkg, "is excluded")
+			continue
+		}
+		parent, title := nearestParent(indexes, pkg)
+		if parent < 0 {
+			title = strings.TrimPrefix(strings.TrimPrefix(pkg, root), "/")
+		}
+		// the trailing slash saves the page as an index.html inside the
+		// directory of its subpackages
+		u := urls[pkg] + "/"
+		indexes[pkg] = len(jobs)
+		jobs = append(jobs, &pkgJob{
+			title:  title,
+			link:   localFile(u),
+			url:    u,
+			pkg:    pkg,
+			parent: parent,
+		})
+	}
+	return jobs
+}
+
+// IsDirectory returns true if the unit page has no documentation
+func (pkgsiteLayout) IsDirectory(doc *goquery.Document) bool {
+	return doc.Find(".Documentation").Length() == 0
+}
+
+// Declarations reads the data-kind attributes of the headers and of the
+// spans inside the declarations
+func (pkgsiteLayout) Declarations(url string, doc *goquery.Document) []*declaration {
+	var (
+		decls     = make([]*declaration, 0)
+		typeName  string
+		signature = func(s *goquery.Selection) string {
+			pre := s.NextAllFiltered(".Documentation-declaration").First().Find("pre")
+			return strings.TrimPrefix(chm.CleanTitle(pre.Text()), "func ")
+		}
+	)
+
+	doc.Find("#pkg-constants, #pkg-variables, [data-kind]").Each(func(i int, s *goquery.Selection) {
+		id, _ := s.Attr("id")
+		link := localLink(url, "#"+id)
+		dataKind, _ := s.Attr("data-kind")
+		switch {
+		case id == "pkg-constants" || id == "pkg-variables":
+			typeName = ""
+		case dataKind == "constant":
+			decls = append(decls, &declaration{kind: "const", label: chm.CleanTitle(s.Text()), typeName: typeName, name: declName(id), link: link})
+		case dataKind == "variable":
+			decls = append(decls, &declaration{kind: "var", label: chm.CleanTitle(s.Text()), typeName: typeName, name: declName(id), link: link})
+		case dataKind == "type":
+			typeName = id
+			decls = append(decls, &declaration{kind: "type", label: id, name: id, link: link})
+		case dataKind == "function":
+			if !s.HasClass("Documentation-typeFuncHeader") {
+				typeName = ""
+			}
+			decls = append(decls, &declaration{kind: "func", label: signature(s), typeName: typeName, name: declName(id), link: link})
+		case dataKind == "method" && typeName != "":
+			text := strings.TrimSpace(funcReceiverRe.ReplaceAllString(signature(s), ""))
+			decls = append(decls, &declaration{kind: "method", label: text, typeName: typeName, name: declName(id), link: link})
+		case dataKind == "field" && typeName != "":
+			decls = append(decls, &declaration{kind: "field", label: chm.CleanTitle(s.Text()), typeName: typeName, name: declName(id), link: link})
+		}
+	})
+	return decls
+}
+
+func (pkgsiteLayout) Examples(url string, doc *goquery.Document) []*pageLink {
+	links := make([]*pageLink, 0)
+	doc.Find(".Documentation-examplesList a").Each(func(i int, a *goquery.Selection) {
+		href, _ := a.Attr("href")
+		links = append(links, &pageLink{label: chm.CleanTitle(a.Text()), href: localLink(url, href)})
+	})
+	return links
+}
+
+func (pkgsiteLayout) SourceFiles(url string, doc *goquery.Document) []*pageLink {
+	links := make([]*pageLink, 0)
+	doc.Find("#section-sourcefiles a, .UnitFiles-fileList a").Each(func(i int, a *goquery.Selection) {
+		if href, _ := a.Attr("href"); href != "" {
+			links = append(links, &pageLink{label: chm.CleanTitle(a.Text()), href: chm.AbsoluteURL(url, href)})
+		}
+	})
+	return links
+}
+
+// OnlinePath keeps the path, a local pkgsite server uses the paths of pkg.go.dev
+func (pkgsiteLayout) OnlinePath(p string) string {
+	return p
+}
+
+// sameHost returns true if both URLs are on the same host
+func sameHost(u1, u2 string) bool {
+	p1, err := urllib.Parse(u1)
+	if err != nil {
+		return false
+	}
+	p2, err := urllib.Parse(u2)
+	if err != nil {
+		return false
+	}
+	return p1.Host == p2.Host
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	urllib "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// page is a file saved during the crawl. The pages are saved as downloaded
+// and their links are rewritten in the render phase, once the files of every
+// crawled URL are known.
+type page struct {
+	URL      string `json:"url"`
+	Location string `json:"location,omitempty"` // URL after redirects
+	File     string `json:"file"`
+	HTML     bool   `json:"html,omitempty"`
+	Hash     string `json:"hash,omitempty"` // content hash in incremental builds
+
+	src *docSource
+	ids map[string]bool // anchors, read from the saved file for reused pages
+}
+
+var (
+	// pages by file
+	pages = make(map[string]*page)
+	// pages by source prefix and link key of their URLs
+	linkMap = make(map[string]*page)
+	// links by URL to the pages outside the crawl
+	outsideLinks = make(map[string]*outsideLink)
+	pagesMu      sync.Mutex
+
+	// policy for the links to pages outside the crawl
+	outsidePolicy = "server"
+	// base URL of the online documentation of the online and external policies
+	onlineBase = "https://pkg.go.dev"
+)
+
+// policies for the links to pages outside the crawl
+var outsidePolicies = []string{"server", "online", "external", "text"}
+
+// outsideLink is a page outside the crawl with the number of links to it
+type outsideLink struct {
+	target string // rewritten URL, empty when the links became text
+	count  int
+}
+
+// base returns the URL the relative links of the page are resolved against
+func (p *page) base() string {
+	if p.Location != "" {
+		return p.Location
+	}
+	return p.URL
+}
+
+// linkKey returns the key of an URL in the link map, the scheme, the query and
+// the fragment do not select another page and a directory is its index.html
+func linkKey(u *urllib.URL) string {
+	return strings.ToLower(u.Host) + strings.TrimSuffix(u.Path, "index.html")
+}
+
+// addPage registers a file of the current source under its URL and the URL it
+// was redirected to, a page registered again keeps its anchors
+func addPage(p *page) {
+	pagesMu.Lock()
+	defer pagesMu.Unlock()
+	if _, ok := pages[p.File]; ok {
+		return
+	}
+	if p.src == nil {
+		p.src = source
+	}
+	pages[p.File] = p
+	for _, url := range []string{p.URL, p.Location} {
+		if u, err := urllib.Parse(url); err == nil && url != "" {
+			if _, ok := linkMap[p.src.prefix+linkKey(u)]; !ok {
+				linkMap[p.src.prefix+linkKey(u)] = p
+			}
+		}
+	}
+}
+
+// addPages registers the pages of a fragment reused from a checkpoint or a
+// previous build, the anchors are not saved with the pages
+func addPages(list []*page) {
+	for _, p := range list {
+		if p.HTML && p.ids == nil {
+			p.ids = fileIDs(p.File)
+		}
+		addPage(p)
+	}
+}
+
+// fileIDs returns the ids and anchor names of a saved page, nil if it cannot be
+// read
+func fileIDs(file string) map[string]bool {
+	data, err := os.ReadFile(filepath.FromSlash(file))
+	if err != nil {
+		return nil
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	return documentIDs(doc)
+}
+
+// fragmentPages returns the pages of the files of a fragment project
+func fragmentPages(files []string) []*page {
+	pagesMu.Lock()
+	defer pagesMu.Unlock()
+	list := make([]*page, 0, len(files))
+	for _, f := range files {
+		if p, ok := pages[strings.Replace(f, `\`, "/", -1)]; ok {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// lookupPage returns the page of an URL, in the source of the linking page
+// first then in the other sources
+func lookupPage(src *docSource, u *urllib.URL) *page {
+	key := linkKey(u)
+	pagesMu.Lock()
+	defer pagesMu.Unlock()
+	if p, ok := linkMap[src.prefix+key]; ok {
+		return p
+	}
+	for _, s := range sources {
+		if p, ok := linkMap[s.prefix+key]; ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// relativeFile returns the path of a project file relative to another one
+func relativeFile(from, to string) string {
+	rel, err := filepath.Rel(filepath.Dir(filepath.FromSlash(from)), filepath.FromSlash(to))
+	if err != nil {
+		return to
+	}
+	return filepath.ToSlash(rel)
+}
+
+// rewriteLink rewrites a link of the page to the local file of its target. A
+// fragment missing from the anchors of the target is dropped. Links to pages
+// of the servers of the sources outside the crawl follow the outside policy.
+func (p *page) rewriteLink(s *goquery.Selection, attr string) {
+	href, _ := s.Attr(attr)
+	href = strings.TrimSpace(href)
+	if href == "" || strings.HasPrefix(href, "#") {
+		return
+	}
+	ref, err := urllib.Parse(href)
+	if err != nil {
+		return
+	}
+	base, err := urllib.Parse(p.base())
+	if err != nil {
+		log.Fatal(err)
+	}
+	u := base.ResolveReference(ref)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return
+	}
+
+	target := lookupPage(p.src, u)
+	if target == nil {
+		if sourceHost(u) {
+			p.outside(s, attr, u)
+		} else {
+			s.SetAttr(attr, u.String())
+		}
+		return
+	}
+	if u.Fragment != "" && target.ids != nil && !target.ids[u.Fragment] {
+		u.Fragment = ""
+	}
+	if target == p && u.Fragment != "" {
+		s.SetAttr(attr, "#"+u.Fragment)
+		return
+	}
+	link := relativeFile(p.File, target.File)
+	if u.Fragment != "" {
+		link += "#" + u.Fragment
+	}
+	s.SetAttr(attr, link)
+}
+
+// sourceHost returns true if the URL is on the server of a source
+func sourceHost(u *urllib.URL) bool {
+	for _, src := range sources {
+		if sameHost(src.url, u.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// outside applies the outside policy to a link to a page that has not been
+// crawled, the stylesheets, scripts and images keep the URL of the server
+func (p *page) outside(s *goquery.Selection, attr string, u *urllib.URL) {
+	policy := outsidePolicy
+	if goquery.NodeName(s) != "a" {
+		policy = "server"
+	}
+
+	target := u.String()
+	switch policy {
+	case "online", "external":
+		if op := layout.OnlinePath(u.Path); op != "" {
+			target = strings.TrimSuffix(onlineBase, "/") + op
+			if u.Fragment != "" {
+				target += "#" + u.Fragment
+			}
+		}
+		if policy == "external" {
+			s.AddClass("external")
+		}
+		s.SetAttr(attr, target)
+	case "text":
+		target = ""
+		if s.Contents().Length() > 0 {
+			s.Contents().Unwrap()
+		} else {
+			s.Remove()
+		}
+	default:
+		s.SetAttr(attr, target)
+	}
+
+	pagesMu.Lock()
+	defer pagesMu.Unlock()
+	l, ok := outsideLinks[u.String()]
+	if !ok {
+		l = &outsideLink{target: target}
+		outsideLinks[u.String()] = l
+	}
+	l.count++
+}
+
+// reportOutsideLinks prints the links to pages outside the crawl and how they
+// have been rewritten
+func reportOutsideLinks() {
+	if len(outsideLinks) == 0 {
+		return
+	}
+	urls := make([]string, 0, len(outsideLinks))
+	n := 0
+	for url, l := range outsideLinks {
+		urls = append(urls, url)
+		n += l.count
+	}
+	sort.Strings(urls)
+	fmt.Printf("%d links to %d pages outside the crawl (%s):\n", n, len(urls), outsidePolicy)
+	for _, url := range urls {
+		l := outsideLinks[url]
+		target := l.target
+		if target == "" {
+			target = "text"
+		}
+		fmt.Printf("  %s -> %s (%d)\n", url, target, l.count)
+	}
+}
+
+// render removes the parts of the layout from a saved page, rewrites its
+// links and adds the custom stylesheet
+func (p *page) render() {
+	data, err := os.ReadFile(p.File)
+	if err != nil {
+		log.Fatal(err)
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+	if err != nil {
+		log.Fatalf("%s: %v", p.File, err)
+	}
+
+	for _, selector := range layout.Remove() {
+		doc.Find(selector).Remove()
+	}
+
+	// custom.css is in the output directory above the directories of the
+	// sources, it is removed first when the page was rendered by a previous build
+	css := relRoot(p.File) + "custom.css"
+	doc.Find(`link[href="` + css + `"]`).Remove()
+
+	for _, attr := range []struct{ selector, name string }{
+		{"a[href]", "href"},
+		{"link[rel='stylesheet'][href]", "href"},
+		{"script[src]", "src"},
+		{"img[src]", "src"},
+	} {
+		doc.Find(attr.selector).Each(func(i int, s *goquery.Selection) {
+			p.rewriteLink(s, attr.name)
+		})
+	}
+
+	doc.Find("head").AppendHtml(`<link rel="stylesheet" href="` + css + `">`)
+
+	save(doc, p.File)
+}
+
+// renderPages renders the pages of every source with the layout of the source
+func renderPages() {
+	for _, src := range sources {
+		source = src
+		layout = src.layout
+
+		list := make([]*page, 0)
+		for _, p := range pages {
+			if p.src == src && p.HTML {
+				list = append(list, p)
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].File < list[j].File })
+		log.Printf("rendering %d pages of %s", len(list), src.label)
+
+		queue := make(chan *page)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for p := range queue {
+					p.render()
+				}
+			}()
+		}
+		for _, p := range list {
+			queue <- p
+		}
+		close(queue)
+		wg.Wait()
+	}
+}
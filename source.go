@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/doc"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/char101/godoc-chm/chm"
+)
+
+var (
+	spaceRe         = regexp.MustCompile(`\s+`)
+	trailingCommaRe = regexp.MustCompile(`,? \)`)
+)
+
+// sourcePackage is a package loaded from the source tree
+type sourcePackage struct {
+	path  string // import path
+	dir   string
+	fset  *token.FileSet
+	doc   *doc.Package
+	files []string // file names without the directory
+}
+
+// modulePath returns the module path declared in dir/go.mod, the standard
+// library module has an empty path
+func modulePath(dir string) (string, bool) {
+	f, err := os.Open(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 2 && fields[0] == "module" {
+			mod := strings.Trim(fields[1], `"`)
+			if mod == "std" {
+				mod = ""
+			}
+			return mod, true
+		}
+	}
+	return "", true
+}
+
+// loadSourcePackages parses every package below root, skipping testdata and
+// vendor directories. The packages of nested modules are loaded with the path
+// of their module.
+func loadSourcePackages(root string) []*sourcePackage {
+	prefix, ok := modulePath(root)
+	if !ok {
+		// a directory outside of a module uses the directory name
+		prefix = filepath.Base(root)
+	}
+
+	pkgs := make([]*sourcePackage, 0, 200)
+	err := filepath.Walk(root, func(dir string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		if dir != root {
+			name := fi.Name()
+			if name == "testdata" || name == "vendor" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+				return filepath.SkipDir
+			}
+			// a nested module like GOROOT/src/cmd has its own path
+			if _, ok := modulePath(dir); ok {
+				pkgs = append(pkgs, loadSourcePackages(dir)...)
+				return filepath.SkipDir
+			}
+		}
+
+		rel, err := filepath.Rel(root, dir)
+		if err != nil {
+			return err
+		}
+		importPath := filepath.ToSlash(rel)
+		if importPath == "." {
+			importPath = prefix
+		} else if prefix != "" {
+			importPath = prefix + "/" + importPath
+		}
+		if importPath == "" {
+			return nil
+		}
+		if isExcluded(importPath) {
+			// the subdirectories may still be included
+			log.Println(importPath, "is excluded")
+			return nil
+		}
+
+		pkg, err := loadSourcePackage(dir, importPath)
+		if err != nil {
+			log.Println("skipping", dir+":", err)
+		} else if pkg != nil {
+			pkgs = append(pkgs, pkg)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return pkgs
+}
+
+// loadSourcePackage parses the package in dir, returning nil if the directory
+// has no Go files for the current platform
+func loadSourcePackage(dir, importPath string) (*sourcePackage, error) {
+	bp, err := build.Default.ImportDir(dir, build.ImportComment)
+	if _, ok := err.(*build.NoGoError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	log.Println("loading", importPath)
+	fset := token.NewFileSet()
+	files := make([]*ast.File, 0, len(bp.GoFiles)+len(bp.TestGoFiles))
+	for _, names := range [][]string{bp.GoFiles, bp.CgoFiles, bp.TestGoFiles, bp.XTestGoFiles} {
+		for _, name := range names {
+			f, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.ParseComments)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, f)
+		}
+	}
+
+	dp, err := doc.NewFromFiles(fset, files, importPath)
+	if err != nil {
+		return nil, err
+	}
+
+	goFiles := append(append([]string(nil), bp.GoFiles...), bp.CgoFiles...)
+	sort.Strings(goFiles)
+	return &sourcePackage{
+		path:  importPath,
+		dir:   dir,
+		fset:  fset,
+		doc:   dp,
+		files: goFiles,
+	}, nil
+}
+
+// file returns the local filename of the package page
+func (sp *sourcePackage) file() string {
+	return "pkg/" + sp.path + "/index.html"
+}
+
+// srcFile returns the local filename of a source file page
+func (sp *sourcePackage) srcFile(name string) string {
+	return "src/" + sp.path + "/" + name + ".html"
+}
+
+// srcLink returns the link to the source line of a node
+func (sp *sourcePackage) srcLink(node ast.Node) string {
+	pos := sp.fset.Position(node.Pos())
+	return fmt.Sprintf("%s#L%d", sp.srcFile(filepath.Base(pos.Filename)), pos.Line)
+}
+
+// print formats a declaration including the comments of its specs and
+// fields, the comments of fields removed by go/doc are left out
+func (sp *sourcePackage) print(node ast.Node) string {
+	comments := make([]*ast.CommentGroup, 0)
+	add := func(groups ...*ast.CommentGroup) {
+		for _, g := range groups {
+			if g != nil {
+				comments = append(comments, g)
+			}
+		}
+	}
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch v := n.(type) {
+		case *ast.Field:
+			add(v.Doc, v.Comment)
+		case *ast.ValueSpec:
+			add(v.Doc, v.Comment)
+		case *ast.TypeSpec:
+			add(v.Doc, v.Comment)
+		}
+		return true
+	})
+	sort.Slice(comments, func(i, j int) bool {
+		return comments[i].Pos() < comments[j].Pos()
+	})
+	return sp.printWith(node, comments)
+}
+
+// printWith formats a node including the comments inside it
+func (sp *sourcePackage) printWith(node interface{}, comments []*ast.CommentGroup) string {
+	var b bytes.Buffer
+	conf := printer.Config{Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
+	if err := conf.Fprint(&b, sp.fset, &printer.CommentedNode{Node: node, Comments: comments}); err != nil {
+		log.Fatal(err)
+	}
+	return b.String()
+}
+
+// signature returns the function name and signature without the func keyword
+// and the receiver, on a single line like in the godoc index
+func (sp *sourcePackage) signature(f *doc.Func) string {
+	decl := &ast.FuncDecl{Name: f.Decl.Name, Type: f.Decl.Type}
+	var b bytes.Buffer
+	if err := printer.Fprint(&b, sp.fset, decl); err != nil {
+		log.Fatal(err)
+	}
+	// parameters on several lines end with a comma
+	text := spaceRe.ReplaceAllString(b.String(), " ")
+	text = strings.Replace(text, "( ", "(", -1)
+	text = trailingCommaRe.ReplaceAllString(text, ")")
+	return strings.TrimPrefix(text, "func ")
+}
+
+// valueNames returns the names declared in a const or var declaration
+func valueNames(decl *ast.GenDecl) []string {
+	names := make([]string, 0)
+	for _, spec := range decl.Specs {
+		for _, n := range spec.(*ast.ValueSpec).Names {
+			if n.Name != "_" {
+				names = append(names, n.Name)
+			}
+		}
+	}
+	return names
+}
+
+// structFields returns the field names of a struct type, using the type name
+// for embedded fields
+func structFields(t *doc.Type) []string {
+	names := make([]string, 0)
+	for _, spec := range t.Decl.Specs {
+		ts, ok := spec.(*ast.TypeSpec)
+		if !ok || ts.Name.Name != t.Name {
+			continue
+		}
+		st, ok := ts.Type.(*ast.StructType)
+		if !ok {
+			continue
+		}
+		for _, f := range st.Fields.List {
+			if len(f.Names) == 0 {
+				if name := embeddedName(f.Type); name != "" {
+					names = append(names, name)
+				}
+			}
+			for _, n := range f.Names {
+				names = append(names, n.Name)
+			}
+		}
+	}
+	return names
+}
+
+func embeddedName(expr ast.Expr) string {
+	switch v := expr.(type) {
+	case *ast.Ident:
+		return v.Name
+	case *ast.StarExpr:
+		return embeddedName(v.X)
+	case *ast.SelectorExpr:
+		return v.Sel.Name
+	case *ast.IndexExpr:
+		return embeddedName(v.X)
+	case *ast.IndexListExpr:
+		return embeddedName(v.X)
+	}
+	return ""
+}
+
+// exampleLabel returns the toc label of an example
+func exampleLabel(ex *doc.Example) string {
+	name := strings.TrimSuffix(ex.Name, "_"+ex.Suffix)
+	if name == "" {
+		name = "Package"
+	}
+	name = strings.Replace(name, "_", ".", 1)
+	if ex.Suffix != "" {
+		name += " (" + ex.Suffix + ")"
+	}
+	return name
+}
+
+// addSourceIndex adds the package declarations to the toc and index
+func addSourceIndex(toc *chm.TocItem, index *chm.IndexItem, sp *sourcePackage) {
+	var (
+		pkg  = sp.path
+		dp   = sp.doc
+		link = func(id string) string {
+			return sp.file() + "#" + id
+		}
+		addValues = func(values []*doc.Value, kind string, t *chm.TocItem) {
+			for _, v := range values {
+				for _, name := range valueNames(v.Decl) {
+					if t != nil {
+						t.Add(name, link(name))
+					}
+					index.Add(fmt.Sprintf("%s%s%s in %s", name, chm.IndexSeparator, kind, pkg)).AddLocal(link(name), pkg)
+				}
+			}
+		}
+		addFunc = func(f *doc.Func, t *chm.TocItem) {
+			text := sp.signature(f)
+			t.Add(text, link(f.Name)).TagAs("function")
+			index.Add(fmt.Sprintf("%s%sfunc in %s", simplifyFunc(text), chm.IndexSeparator, pkg)).AddLocal(link(f.Name), pkg)
+		}
+	)
+
+	if len(dp.Consts) > 0 {
+		addValues(dp.Consts, "const", toc.Add("Constants", link("pkg-constants")))
+	}
+	if len(dp.Vars) > 0 {
+		addValues(dp.Vars, "var", toc.Add("Variables", link("pkg-variables")))
+	}
+	for _, f := range dp.Funcs {
+		addFunc(f, toc)
+	}
+	for _, t := range dp.Types {
+		tt := toc.Add(t.Name, link(t.Name))
+		tt.TagAs("type")
+		index.Add(fmt.Sprintf("%s%stype in %s", t.Name, chm.IndexSeparator, pkg)).AddLocal(link(t.Name), pkg)
+
+		addValues(t.Consts, "const", nil)
+		addValues(t.Vars, "var", nil)
+		for _, f := range t.Funcs {
+			addFunc(f, tt)
+		}
+		for _, m := range t.Methods {
+			id := t.Name + "." + m.Name
+			text := sp.signature(m)
+			tt.Add(text, link(id)).TagAs("method")
+			if !strings.HasPrefix(text, "String() string") {
+				index.Add(fmt.Sprintf("%s%smethod of %s in %s", simplifyFunc(text), chm.IndexSeparator, t.Name, pkg)).AddLocal(link(id), pkg)
+			}
+		}
+
+		if fields := structFields(t); len(fields) > 0 {
+			ft := tt.Add("Fields", "")
+			for _, name := range fields {
+				id := t.Name + "." + name
+				ft.Add(name, link(id)).TagAs("field")
+				index.Add(fmt.Sprintf("%s%sfield of %s in %s", name, chm.IndexSeparator, t.Name, pkg)).AddLocal(link(id), pkg)
+			}
+		}
+	}
+
+	if examples := sp.examples(); len(examples) > 0 {
+		t := toc.Add("Examples", "")
+		for _, ex := range examples {
+			t.Add(exampleLabel(ex), link("example_"+ex.Name))
+		}
+	}
+
+	if len(sp.files) > 0 {
+		t := toc.Add("Files", "")
+		for _, name := range sp.files {
+			t.Add(name, sp.srcFile(name)).TagAs("file")
+		}
+	}
+}
+
+// examples returns all examples of the package sorted by name
+func (sp *sourcePackage) examples() []*doc.Example {
+	dp := sp.doc
+	examples := append([]*doc.Example(nil), dp.Examples...)
+	for _, f := range dp.Funcs {
+		examples = append(examples, f.Examples...)
+	}
+	for _, t := range dp.Types {
+		examples = append(examples, t.Examples...)
+		for _, f := range t.Funcs {
+			examples = append(examples, f.Examples...)
+		}
+		for _, m := range t.Methods {
+			examples = append(examples, m.Examples...)
+		}
+	}
+	sort.Slice(examples, func(i, j int) bool {
+		return examples[i].Name < examples[j].Name
+	})
+	return examples
+}
+
+// sourceDirs returns the directories containing the packages, including
+// the intermediate directories without Go files
+func sourceDirs(pkgs []*sourcePackage) []string {
+	seen := make(map[string]bool)
+	for _, sp := range pkgs {
+		parts := strings.Split(sp.path, "/")
+		for i := 1; i <= len(parts); i++ {
+			seen[strings.Join(parts[:i], "/")] = true
+		}
+	}
+	dirs := make([]string, 0, len(seen))
+	for d := range seen {
+		dirs = append(dirs, d)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return comparePath(dirs[i], dirs[j]) < 0
+	})
+	return dirs
+}
+
+// comparePath compares import paths segment by segment so that children are
+// sorted right after their parent
+func comparePath(p1, p2 string) int {
+	s1 := strings.Split(p1, "/")
+	s2 := strings.Split(p2, "/")
+	for i := 0; i < len(s1) && i < len(s2); i++ {
+		if s1[i] != s2[i] {
+			if s1[i] < s2[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(s1) - len(s2)
+}
+
+// buildFromSource creates the project from the packages below root without
+// using a godoc server
+func buildFromSource(root string) {
+	pkgs := loadSourcePackages(root)
+	byPath := make(map[string]*sourcePackage, len(pkgs))
+	for _, sp := range pkgs {
+		byPath[sp.path] = sp
+	}
+
+	var (
+		toc   = project.Toc().Root()
+		index = project.Index().Root()
+		nodes = make(map[string]*chm.TocItem)
+		dirs  = sourceDirs(pkgs)
+	)
+	for _, dir := range dirs {
+		parent := toc
+		title := dir
+		if i := strings.LastIndex(dir, "/"); i >= 0 {
+			parent = nodes[dir[:i]]
+			title = dir[i+1:]
+		}
+
+		sp := byPath[dir]
+		if sp == nil {
+			file := "pkg/" + dir + "/index.html"
+			renderDirectory(dir, subPackages(dir, dirs, byPath), file)
+			nodes[dir] = parent.Add(title, file)
+			nodes[dir].TagAs("directory")
+			continue
+		}
+
+		tc := parent.Add(title, sp.file())
+		nodes[dir] = tc
+		renderPackage(sp)
+		addSourceIndex(tc, index, sp)
+		indexTitle := fmt.Sprintf("%s%spackage %s", title, chm.IndexSeparator, sp.path)
+		index.Add(indexTitle).AddLocal(sp.file(), sp.path)
+	}
+
+	renderDirectory("", pkgs, "pkg/index.html")
+}
+
+// subPackages returns the packages below dir
+func subPackages(dir string, dirs []string, byPath map[string]*sourcePackage) []*sourcePackage {
+	pkgs := make([]*sourcePackage, 0)
+	for _, d := range dirs {
+		if sp := byPath[d]; sp != nil && strings.HasPrefix(d, dir+"/") {
+			pkgs = append(pkgs, sp)
+		}
+	}
+	return pkgs
+}
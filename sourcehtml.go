@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/doc"
+	"go/doc/comment"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// templates of the pages rendered by the source front end, the ids follow the
+// godoc layout so that the same links work for both front ends
+var sourceTemplates = template.Must(template.New("").Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8">
+<title>{{.Title}}</title>
+<link rel="stylesheet" href="{{.Root}}custom.css">
+</head>
+<body>
+<div id="page">
+{{end}}
+
+{{define "footer"}}</div>
+</body>
+</html>
+{{end}}
+
+{{define "examples"}}{{range .}}
+<div class="example" id="example_{{.Name}}">
+<p><b>Example{{if .Label}} ({{.Label}}){{end}}</b></p>
+<pre>{{.Code}}</pre>
+{{if .Output}}<p>Output:</p>
+<pre>{{.Output}}</pre>{{end}}
+</div>
+{{end}}{{end}}
+
+{{define "decl"}}<h{{.Level}} id="{{.ID}}">{{.Kind}} <a href="{{.Src}}">{{.Name}}</a></h{{.Level}}>
+<pre>{{.Code}}</pre>
+{{.Doc}}
+{{range .Values}}<pre>{{.Code}}</pre>
+{{.Doc}}
+{{end}}{{template "examples" .Examples}}
+{{range .Decls}}{{template "decl" .}}{{end}}
+{{end}}
+
+{{define "package"}}{{template "header" .}}<h1>Package {{.Name}}</h1>
+<p><code>import "{{.ImportPath}}"</code></p>
+<dl>
+<dd><a href="#pkg-overview">Overview</a></dd>
+<dd><a href="#pkg-index">Index</a></dd>
+{{if .Examples}}<dd><a href="#pkg-examples">Examples</a></dd>{{end}}
+</dl>
+<h2 id="pkg-overview">Overview</h2>
+{{.Doc}}
+{{template "examples" .PackageExamples}}
+<h2 id="pkg-index">Index</h2>
+<ul>
+{{if .Consts}}<li><a href="#pkg-constants">Constants</a></li>{{end}}
+{{if .Vars}}<li><a href="#pkg-variables">Variables</a></li>{{end}}
+{{range .Index}}<li>{{.Indent}}<a href="#{{.ID}}">{{.Text}}</a></li>
+{{end}}</ul>
+{{if .Examples}}<h3 id="pkg-examples">Examples</h3>
+<ul>
+{{range .Examples}}<li><a href="#example_{{.Name}}">{{.Title}}</a></li>
+{{end}}</ul>{{end}}
+<h3 id="pkg-files">Package files</h3>
+<p>{{range .Files}}<a href="{{.Href}}">{{.Name}}</a> {{end}}</p>
+{{if .Consts}}<h2 id="pkg-constants">Constants</h2>
+{{range .Consts}}<pre>{{.Code}}</pre>
+{{.Doc}}
+{{end}}{{end}}
+{{if .Vars}}<h2 id="pkg-variables">Variables</h2>
+{{range .Vars}}<pre>{{.Code}}</pre>
+{{.Doc}}
+{{end}}{{end}}
+{{range .Decls}}{{template "decl" .}}{{end}}
+{{template "footer" .}}{{end}}
+
+{{define "directory"}}{{template "header" .}}<h1>{{.Title}}</h1>
+<table>
+{{range .Packages}}<tr><td class="pkg-name"><a href="{{.Href}}">{{.Name}}</a></td><td>{{.Synopsis}}</td></tr>
+{{end}}</table>
+{{template "footer" .}}{{end}}
+
+{{define "source"}}{{template "header" .}}<h1>Source file <a href="{{.Package}}">{{.Title}}</a></h1>
+<pre>{{range .Lines}}<span id="L{{.Number}}" class="ln">{{printf "%6d" .Number}}</span>  {{.Text}}
+{{end}}</pre>
+{{template "footer" .}}{{end}}
+`))
+
+type exampleView struct {
+	Name   string
+	Title  string
+	Label  string
+	Code   template.HTML
+	Output string
+}
+
+type declView struct {
+	Level    int
+	ID       string
+	Kind     string
+	Name     string
+	Src      string
+	Code     template.HTML
+	Doc      template.HTML
+	Examples []exampleView
+	Values   []declView
+	Decls    []declView
+}
+
+type indexEntry struct {
+	ID     string
+	Text   string
+	Indent template.HTML
+}
+
+type linkView struct {
+	Name     string
+	Href     string
+	Synopsis string
+}
+
+// relRoot returns the relative path from a local file to the output directory
+func relRoot(file string) string {
+	return strings.Repeat("../", strings.Count(file, "/"))
+}
+
+// writePage renders a template into a project file
+func writePage(name string, data interface{}, file string) {
+	var b bytes.Buffer
+	if err := sourceTemplates.ExecuteTemplate(&b, name, data); err != nil {
+		log.Fatal(err)
+	}
+	save(b.Bytes(), file)
+	project.AddFile(file)
+}
+
+var wordRe = regexp.MustCompile(`\w+`)
+
+// anchorNames escapes code and wraps the first occurrence of each name,
+// searched after the previous one and outside comments, in a span with the
+// matching id
+func anchorNames(code string, names, ids []string) template.HTML {
+	// byte ranges of line comments
+	comments := make([][2]int, 0)
+	pos := 0
+	for _, line := range strings.SplitAfter(code, "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			comments = append(comments, [2]int{pos + i, pos + len(line)})
+		}
+		pos += len(line)
+	}
+	inComment := func(i int) bool {
+		for _, c := range comments {
+			if i >= c[0] && i < c[1] {
+				return true
+			}
+		}
+		return false
+	}
+
+	var (
+		b    strings.Builder
+		prev = 0
+		next = 0
+	)
+	for _, loc := range wordRe.FindAllStringIndex(code, -1) {
+		if next >= len(names) {
+			break
+		}
+		if code[loc[0]:loc[1]] != names[next] || inComment(loc[0]) {
+			continue
+		}
+		b.WriteString(template.HTMLEscapeString(code[prev:loc[0]]))
+		fmt.Fprintf(&b, `<span id="%s">%s</span>`, template.HTMLEscapeString(ids[next]), names[next])
+		prev = loc[1]
+		next++
+	}
+	b.WriteString(template.HTMLEscapeString(code[prev:]))
+	return template.HTML(b.String())
+}
+
+// docHTML formats a doc comment, resolving doc links relative to the page
+func (sp *sourcePackage) docHTML(text, root string) template.HTML {
+	p := sp.doc.Printer()
+	p.DocLinkURL = func(link *comment.DocLink) string {
+		id := link.Name
+		if link.Recv != "" {
+			id = link.Recv + "." + id
+		}
+		if link.ImportPath == "" || link.ImportPath == sp.path {
+			return "#" + id
+		}
+		href := root + "pkg/" + link.ImportPath + "/index.html"
+		if id != "" {
+			href += "#" + id
+		}
+		return href
+	}
+	return template.HTML(p.HTML(sp.doc.Parser().Parse(text)))
+}
+
+func (sp *sourcePackage) exampleViews(examples []*doc.Example) []exampleView {
+	views := make([]exampleView, 0, len(examples))
+	for _, ex := range examples {
+		views = append(views, exampleView{
+			Name:   ex.Name,
+			Title:  exampleLabel(ex),
+			Label:  ex.Suffix,
+			Code:   template.HTML(template.HTMLEscapeString(sp.printExample(ex))),
+			Output: ex.Output,
+		})
+	}
+	return views
+}
+
+// printExample formats the example body without the enclosing braces
+func (sp *sourcePackage) printExample(ex *doc.Example) string {
+	code := sp.printWith(ex.Code, ex.Comments)
+	if _, ok := ex.Code.(*ast.BlockStmt); ok {
+		code = strings.TrimSuffix(strings.TrimPrefix(code, "{\n"), "}")
+		lines := strings.Split(code, "\n")
+		for i, l := range lines {
+			lines[i] = strings.TrimPrefix(l, "\t")
+		}
+		code = strings.Join(lines, "\n")
+	}
+	return code
+}
+
+// valueViews renders const and var declarations
+func (sp *sourcePackage) valueViews(values []*doc.Value, root string) []declView {
+	views := make([]declView, 0, len(values))
+	for _, v := range values {
+		names := valueNames(v.Decl)
+		views = append(views, declView{
+			Code: anchorNames(sp.print(v.Decl), names, names),
+			Doc:  sp.docHTML(v.Doc, root),
+		})
+	}
+	return views
+}
+
+func (sp *sourcePackage) funcView(f *doc.Func, id string, level int, root string) declView {
+	kind := "func"
+	if f.Recv != "" {
+		kind = "func (" + f.Recv + ")"
+	}
+	return declView{
+		Level:    level,
+		ID:       id,
+		Kind:     kind,
+		Name:     f.Name,
+		Src:      root + sp.srcLink(f.Decl),
+		Code:     template.HTML(template.HTMLEscapeString(sp.print(f.Decl))),
+		Doc:      sp.docHTML(f.Doc, root),
+		Examples: sp.exampleViews(f.Examples),
+	}
+}
+
+// renderPackage writes the package page and its source files
+func renderPackage(sp *sourcePackage) {
+	var (
+		dp    = sp.doc
+		file  = sp.file()
+		root  = relRoot(file)
+		index = make([]indexEntry, 0)
+		decls = make([]declView, 0)
+	)
+
+	for _, f := range dp.Funcs {
+		index = append(index, indexEntry{ID: f.Name, Text: "func " + sp.signature(f)})
+		decls = append(decls, sp.funcView(f, f.Name, 2, root))
+	}
+	for _, t := range dp.Types {
+		index = append(index, indexEntry{ID: t.Name, Text: "type " + t.Name})
+		fields := structFields(t)
+		ids := make([]string, len(fields))
+		for i, name := range fields {
+			ids[i] = t.Name + "." + name
+		}
+		tv := declView{
+			Level:    2,
+			ID:       t.Name,
+			Kind:     "type",
+			Name:     t.Name,
+			Src:      root + sp.srcLink(t.Decl),
+			Code:     anchorNames(sp.print(t.Decl), fields, ids),
+			Doc:      sp.docHTML(t.Doc, root),
+			Examples: sp.exampleViews(t.Examples),
+		}
+		tv.Values = append(sp.valueViews(t.Consts, root), sp.valueViews(t.Vars, root)...)
+		for _, f := range t.Funcs {
+			index = append(index, indexEntry{ID: f.Name, Text: "func " + sp.signature(f), Indent: "&nbsp;&nbsp;&nbsp;&nbsp;"})
+			tv.Decls = append(tv.Decls, sp.funcView(f, f.Name, 3, root))
+		}
+		for _, m := range t.Methods {
+			id := t.Name + "." + m.Name
+			index = append(index, indexEntry{ID: id, Text: "func (" + m.Recv + ") " + sp.signature(m), Indent: "&nbsp;&nbsp;&nbsp;&nbsp;"})
+			tv.Decls = append(tv.Decls, sp.funcView(m, id, 3, root))
+		}
+		decls = append(decls, tv)
+	}
+
+	files := make([]linkView, 0, len(sp.files))
+	for _, name := range sp.files {
+		files = append(files, linkView{Name: name, Href: root + sp.srcFile(name)})
+		renderSource(sp, name)
+	}
+
+	writePage("package", map[string]interface{}{
+		"Title":           "Package " + dp.Name,
+		"Root":            root,
+		"Name":            dp.Name,
+		"ImportPath":      sp.path,
+		"Doc":             sp.docHTML(dp.Doc, root),
+		"PackageExamples": sp.exampleViews(dp.Examples),
+		"Examples":        sp.exampleViews(sp.examples()),
+		"Index":           index,
+		"Consts":          sp.valueViews(dp.Consts, root),
+		"Vars":            sp.valueViews(dp.Vars, root),
+		"Decls":           decls,
+		"Files":           files,
+	}, file)
+}
+
+type lineView struct {
+	Number int
+	Text   string
+}
+
+// renderSource writes a source file page with a line anchor for every line
+func renderSource(sp *sourcePackage, name string) {
+	src, err := ioutil.ReadFile(filepath.Join(sp.dir, name))
+	if err != nil {
+		log.Fatal(err)
+	}
+	lines := make([]lineView, 0)
+	for i, l := range strings.Split(strings.TrimSuffix(string(src), "\n"), "\n") {
+		lines = append(lines, lineView{i + 1, l})
+	}
+	file := sp.srcFile(name)
+	root := relRoot(file)
+	writePage("source", map[string]interface{}{
+		"Title":   sp.path + "/" + name,
+		"Root":    root,
+		"Package": root + sp.file(),
+		"Lines":   lines,
+	}, file)
+}
+
+// renderDirectory writes a page listing the packages below a directory
+func renderDirectory(dir string, pkgs []*sourcePackage, file string) {
+	root := relRoot(file)
+	links := make([]linkView, 0, len(pkgs))
+	for _, sp := range pkgs {
+		links = append(links, linkView{
+			Name:     strings.TrimPrefix(strings.TrimPrefix(sp.path, dir), "/"),
+			Href:     root + sp.file(),
+			Synopsis: sp.doc.Synopsis(sp.doc.Doc),
+		})
+	}
+	title := "Packages"
+	if dir != "" {
+		title = "Directory /" + dir
+	}
+	writePage("directory", map[string]interface{}{
+		"Title":    title,
+		"Root":     root,
+		"Packages": links,
+	}, file)
+}
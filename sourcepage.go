@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// sourceDecl is a top-level declaration of a source file, the specs of a
+// grouped const, var or type declaration are separate declarations
+type sourceDecl struct {
+	label string
+	kind  string // toc tag, empty for constants and variables
+	name  string
+	start int // first line
+	end   int // last line
+}
+
+// anchor returns the id of the lines of the declaration
+func (d *sourceDecl) anchor() string {
+	if d.start == d.end {
+		return fmt.Sprintf("L%d", d.start)
+	}
+	return fmt.Sprintf("L%d-L%d", d.start, d.end)
+}
+
+// sourceFile is a source page split into lines with the declarations of the
+// file, the declarations are only known for Go files that parse
+type sourceFile struct {
+	file  *token.File
+	decls []*sourceDecl
+}
+
+// line returns the line of a byte offset of the file, or 0 if unknown
+func (sf *sourceFile) line(offset int) int {
+	if sf.file == nil || offset < 0 || offset > sf.file.Size() {
+		return 0
+	}
+	return sf.file.Line(sf.file.Pos(offset))
+}
+
+// anchorAt returns the id of the declaration containing a line, or of the line
+func (sf *sourceFile) anchorAt(line int) string {
+	for _, d := range sf.decls {
+		if d.start <= line && line <= d.end {
+			return d.anchor()
+		}
+	}
+	return fmt.Sprintf("L%d", line)
+}
+
+// targetScript highlights the line or declaration of the fragment by setting the
+// class target, hh.exe renders the pages like IE7 which does not support
+// :target and the hashchange event
+const targetScript = `<script type="text/javascript">
+(function() {
+	var hash = null, marked = null;
+	function mark() {
+		if (location.hash == hash) {
+			return;
+		}
+		hash = location.hash;
+		if (marked) {
+			marked.className = marked.className.replace(/ target$/, "");
+		}
+		marked = hash ? document.getElementById(hash.substring(1)) : null;
+		if (marked && /^(line|decl)$/.test(marked.className)) {
+			marked.className += " target";
+		} else {
+			marked = null;
+		}
+	}
+	mark();
+	setInterval(mark, 200);
+})();
+</script>`
+
+// formatSource gives every line of the code of a source page the id Ln, and
+// wraps the lines of every declaration longer than a line in an element with
+// the id Lstart-Lend so that both can be targeted and highlighted
+func formatSource(name string, doc *goquery.Document) *sourceFile {
+	sf := &sourceFile{}
+	pre := doc.Find("#page pre").First()
+	if pre.Length() == 0 {
+		pre = doc.Find("pre").First()
+	}
+	if pre.Length() == 0 {
+		return sf
+	}
+	doc.Find("body").AppendHtml(targetScript)
+
+	lines := splitLines(pre.Nodes[0])
+	if strings.HasSuffix(name, ".go") {
+		texts := make([]string, len(lines))
+		for i, l := range lines {
+			texts[i] = nodeText(l)
+		}
+		sf.file, sf.decls = parseDecls(name, strings.Join(texts, "\n")+"\n")
+	}
+
+	var (
+		p         = pre.Nodes[0]
+		container = p
+		next      = 0
+		open      *sourceDecl
+	)
+	for i, l := range lines {
+		n := i + 1
+		if open == nil {
+			// single line and overlapping declarations are not wrapped
+			for next < len(sf.decls) && sf.decls[next].start < n {
+				next++
+			}
+			if next < len(sf.decls) && sf.decls[next].start == n && sf.decls[next].end > n {
+				open = sf.decls[next]
+				container = element("span", "decl", open.anchor())
+				p.AppendChild(container)
+			}
+		}
+
+		line := element("span", "line", fmt.Sprintf("L%d", n))
+		ln := element("span", "ln", "")
+		ln.AppendChild(&html.Node{Type: html.TextNode, Data: fmt.Sprintf("%6d  ", n)})
+		line.AppendChild(ln)
+		for c := l.FirstChild; c != nil; {
+			next := c.NextSibling
+			l.RemoveChild(c)
+			line.AppendChild(c)
+			c = next
+		}
+		container.AppendChild(line)
+		if i < len(lines)-1 {
+			container.AppendChild(&html.Node{Type: html.TextNode, Data: "\n"})
+		}
+
+		if open != nil && n == open.end {
+			open = nil
+			container = p
+			next++
+		}
+	}
+	return sf
+}
+
+// splitLines removes the content of a pre element and returns it as one node
+// per line. The elements spanning several lines, like comments, are split at
+// the line breaks, and the line numbers added by godoc are dropped.
+func splitLines(pre *html.Node) []*html.Node {
+	var (
+		lines  []*html.Node
+		open   []*html.Node // elements containing the current position, outermost first
+		parent *html.Node
+	)
+	newLine := func() {
+		parent = &html.Node{Type: html.ElementNode, Data: "span", DataAtom: atom.Span}
+		lines = append(lines, parent)
+		for _, n := range open {
+			c := cloneElement(n)
+			parent.AppendChild(c)
+			parent = c
+		}
+	}
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			switch c.Type {
+			case html.TextNode:
+				for i, text := range strings.Split(c.Data, "\n") {
+					if i > 0 {
+						newLine()
+					}
+					if text != "" {
+						parent.AppendChild(&html.Node{Type: html.TextNode, Data: text})
+					}
+				}
+			case html.ElementNode:
+				if hasClass(c, "ln") {
+					continue
+				}
+				e := cloneElement(c)
+				parent.AppendChild(e)
+				parent = e
+				open = append(open, c)
+				walk(c)
+				open = open[:len(open)-1]
+				// the element may have been split, continue after its last part
+				parent = parent.Parent
+			}
+		}
+	}
+	newLine()
+	walk(pre)
+	for c := pre.FirstChild; c != nil; {
+		next := c.NextSibling
+		pre.RemoveChild(c)
+		c = next
+	}
+
+	// the code ends with a line break
+	if len(lines) > 1 && nodeText(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// parseDecls returns the top-level declarations of a Go source file sorted by
+// line
+func parseDecls(name, src string) (*token.File, []*sourceDecl) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, name, src, 0)
+	if err != nil {
+		return nil, nil
+	}
+
+	var (
+		decls = make([]*sourceDecl, 0)
+		add   = func(label, kind, name string, node ast.Node) {
+			decls = append(decls, &sourceDecl{
+				label: label,
+				kind:  kind,
+				name:  name,
+				start: fset.Position(node.Pos()).Line,
+				end:   fset.Position(node.End()).Line,
+			})
+		}
+	)
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv != nil && len(d.Recv.List) > 0 {
+				add(embeddedName(d.Recv.List[0].Type)+"."+d.Name.Name+"()", "method", d.Name.Name, d)
+			} else {
+				add(d.Name.Name+"()", "function", d.Name.Name, d)
+			}
+		case *ast.GenDecl:
+			if d.Tok == token.IMPORT {
+				continue
+			}
+			for _, spec := range d.Specs {
+				// a declaration without parentheses starts at its keyword
+				var node ast.Node = spec
+				if !d.Lparen.IsValid() {
+					node = d
+				}
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					add(s.Name.Name, "type", s.Name.Name, node)
+				case *ast.ValueSpec:
+					names := make([]string, 0, len(s.Names))
+					for _, n := range s.Names {
+						if n.Name != "_" {
+							names = append(names, n.Name)
+						}
+					}
+					if len(names) > 0 {
+						add(strings.Join(names, ", "), "", names[0], node)
+					}
+				}
+			}
+		}
+	}
+	sort.SliceStable(decls, func(i, j int) bool { return decls[i].start < decls[j].start })
+	return fset.File(f.Pos()), decls
+}
+
+// selectionLine returns the line selected by a godoc source link, from the
+// start offset of ?s=start:end or from the #Ln fragment
+func selectionLine(sf *sourceFile, selection, fragment string) int {
+	if selection != "" {
+		start, _, _ := strings.Cut(selection, ":")
+		if offset, err := strconv.Atoi(start); err == nil {
+			if line := sf.line(offset); line > 0 {
+				return line
+			}
+		}
+	}
+	if strings.HasPrefix(fragment, "L") {
+		if line, err := strconv.Atoi(fragment[1:]); err == nil {
+			return line
+		}
+	}
+	return 0
+}
+
+func element(tag, class, id string) *html.Node {
+	n := &html.Node{Type: html.ElementNode, Data: tag, DataAtom: atom.Lookup([]byte(tag))}
+	if id != "" {
+		n.Attr = append(n.Attr, html.Attribute{Key: "id", Val: id})
+	}
+	if class != "" {
+		n.Attr = append(n.Attr, html.Attribute{Key: "class", Val: class})
+	}
+	return n
+}
+
+// cloneElement returns a copy of an element without its children and its id
+func cloneElement(n *html.Node) *html.Node {
+	c := &html.Node{Type: n.Type, Data: n.Data, DataAtom: n.DataAtom, Namespace: n.Namespace}
+	for _, a := range n.Attr {
+		if a.Key != "id" {
+			c.Attr = append(c.Attr, a)
+		}
+	}
+	return c
+}
+
+func hasClass(n *html.Node, class string) bool {
+	for _, a := range n.Attr {
+		if a.Key == "class" {
+			for _, c := range strings.Fields(a.Val) {
+				if c == class {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// nodeText returns the text of a node and its descendants
+func nodeText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(nodeText(c))
+	}
+	return b.String()
+}
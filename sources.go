@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	urllib "net/url"
+	"regexp"
+	"strings"
+
+	"github.com/char101/godoc-chm/chm"
+)
+
+// docSource is a documentation server, or a root on a server, given on the
+// command line as url or label=url, for a single platform
+type docSource struct {
+	label    string
+	url      string
+	platform string // GOOS/GOARCH of the package pages, empty for the server default
+	prefix   string // directory of the files of the source, empty with a single source
+	layout   Layout
+	toc      *chm.TocItem
+}
+
+var (
+	// source being crawled
+	source = &docSource{}
+	// sources given on the command line
+	sources []*docSource
+
+	slugRe     = regexp.MustCompile(`[^a-z0-9]+`)
+	platformRe = regexp.MustCompile(`^\w+(/\w+)?$`)
+)
+
+// parseSources reads the sources given on the command line, each source is
+// crawled once for every platform. With several sources the files of each
+// source are stored in a directory named after its label so that the same path
+// on two servers or for two platforms does not collide.
+func parseSources(args []string, platforms []string) []*docSource {
+	if len(platforms) == 0 {
+		platforms = []string{""}
+	}
+	for i, p := range platforms {
+		p = strings.TrimSpace(p)
+		platforms[i] = p
+		if p != "" && !platformRe.MatchString(p) {
+			log.Fatalf("invalid platform %s, expected goos or goos/goarch", p)
+		}
+	}
+
+	srcs := make([]*docSource, 0, len(args)*len(platforms))
+	prefixes := make(map[string]bool)
+	for _, arg := range args {
+		label, url := "", arg
+		if i := strings.Index(arg, "="); i > 0 && !strings.Contains(arg[:i], "/") {
+			label, url = arg[:i], arg[i+1:]
+		}
+		if label == "" {
+			u, err := urllib.Parse(url)
+			if err != nil {
+				log.Fatal(err)
+			}
+			label = strings.TrimSuffix(u.Host+u.Path, "/")
+		}
+
+		for _, platform := range platforms {
+			src := &docSource{label: label, url: url, platform: platform}
+			if platform != "" {
+				if len(args) > 1 {
+					src.label = label + " " + platform
+				} else {
+					src.label = platform
+				}
+			}
+			if len(args)*len(platforms) > 1 {
+				slug := strings.Trim(slugRe.ReplaceAllString(strings.ToLower(src.label), "-"), "-")
+				if slug == "" {
+					slug = "source"
+				}
+				prefix := slug
+				for n := 2; prefixes[prefix]; n++ {
+					prefix = fmt.Sprintf("%s-%d", slug, n)
+				}
+				prefixes[prefix] = true
+				src.prefix = prefix + "/"
+			}
+			srcs = append(srcs, src)
+		}
+	}
+	return srcs
+}
+
+// localFile returns the file of an URL of the current source
+func localFile(url string) string {
+	return source.prefix + chm.GetFilename(url)
+}
+
+// pageURL returns the URL of a package page for the platform of the current
+// source, with the unexported declarations when requested
+func pageURL(url string) string {
+	if source.platform == "" && !allSymbols {
+		return url
+	}
+	u, err := urllib.Parse(url)
+	if err != nil {
+		log.Fatal(err)
+	}
+	q := u.Query()
+	if source.platform != "" {
+		goos, goarch, _ := strings.Cut(source.platform, "/")
+		q.Set("GOOS", goos)
+		if goarch != "" {
+			q.Set("GOARCH", goarch)
+		}
+	}
+	// only godoc renders the unexported declarations
+	if allSymbols && layout.Name() == "godoc" {
+		q.Set("m", "all")
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// topic returns the title of the index entries of a package, the label of the
+// source is added when there are several sources and the platform when there
+// is one
+func topic(pkg string) string {
+	if len(sources) > 1 {
+		return fmt.Sprintf("%s (%s)", pkg, source.label)
+	} else if source.platform != "" {
+		return fmt.Sprintf("%s (%s)", pkg, source.platform)
+	}
+	return pkg
+}